@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+)
+
+// backfillPageSize is the number of loans fetched from Cassandra at a time
+const backfillPageSize = 500
+
+// Copies loans created before the loans by due day table was added into it, so that the due soon check finds them.
+// Rows are only inserted if they don't already exist, so it is safe to run more than once and while the loans service
+// is running.
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Log the loans that would be copied without copying them")
+	flag.Parse()
+
+	log.Println("Loans by due day backfill starting...")
+
+	cfg, err := config.LoadBackfillConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	session, err := cassandra.NewSession(cfg.CassandraConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Cassandra session: %v", err)
+	}
+
+	copied, err := backfill(session, cfg.TimeZone, *dryRun)
+	session.Close()
+	if err != nil {
+		// Exit with an error so that make migrate-up doesn't go on to drop the indexes
+		log.Fatalf("Failed to backfill loans by due day after copying %d loan(s): %v", copied, err)
+	}
+
+	log.Printf("Copied %d loan(s) into loans by due day", copied)
+}
+
+// backfill copies every loan that hasn't been returned into the loans by due day table. It returns the number of
+// loans copied, which excludes loans that were already there.
+func backfill(session *gocql.Session, location *time.Location, dryRun bool) (int, error) {
+	loans := session.Query(
+		`SELECT borrower_id, due_date, book_id,
+		        borrower_name, borrower_email, borrower_language,
+		        book_title, book_author,
+		        due_soon_notification_sent, returned_date
+		 FROM loans`,
+	).PageSize(backfillPageSize).Idempotent(true).Iter()
+
+	var (
+		borrowerID, bookID                                           gocql.UUID
+		dueDate, returnedDate                                        time.Time
+		borrowerName, borrowerEmail, borrowerLanguage, title, author string
+		notificationSent                                             bool
+		copied                                                       int
+	)
+	for loans.Scan(
+		&borrowerID, &dueDate, &bookID,
+		&borrowerName, &borrowerEmail, &borrowerLanguage,
+		&title, &author,
+		&notificationSent, &returnedDate,
+	) {
+		if !returnedDate.IsZero() {
+			continue
+		}
+		// Due dates are midnight in the library's time zone, which is the day they are partitioned by
+		dueDay := dueDate.In(location).Format(time.DateOnly)
+		if dryRun {
+			log.Printf("Would copy loan of book %s to borrower %s due on %s", bookID, borrowerID, dueDay)
+			continue
+		}
+
+		// Don't overwrite rows the loans service or the due soon check have written since
+		applied, err := session.Query(
+			`INSERT INTO loans_by_due_day (
+				due_day, borrower_id, book_id, due_date,
+				borrower_name, borrower_email, borrower_language,
+				book_title, book_author, due_soon_notification_sent
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			IF NOT EXISTS`,
+			dueDay, borrowerID, bookID, dueDate,
+			borrowerName, borrowerEmail, borrowerLanguage,
+			title, author, notificationSent,
+		).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			loans.Close()
+			return copied, fmt.Errorf("failed to copy loan of book %s to borrower %s: %w", bookID, borrowerID, err)
+		}
+		if applied {
+			copied++
+		}
+	}
+	return copied, loans.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+)
+
+// The due loans benchmarks compare reading a day's loans from the loans by due day table with querying the loans table
+// through the SAI indexes on due date and notification status that the due soon check used before. They need a
+// Cassandra cluster, e.g. the one started by make start-docker-services, and are skipped unless CASSANDRA_HOSTS is
+// set. They create their own keyspace rather than using the library's, as the library's indexes are dropped once
+// loans have been copied into loans by due day.
+const (
+	benchmarkKeyspace    = "due_loans_benchmark"
+	benchmarkDays        = 30
+	benchmarkLoansPerDay = 200
+)
+
+var (
+	benchmarkOnce    sync.Once
+	benchmarkSession *gocql.Session
+	benchmarkErr     error
+	benchmarkStart   = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// dueLoansBenchmarkSession returns a session for a keyspace with benchmarkDays days of loans in both tables, a quarter
+// of which have been notified
+func dueLoansBenchmarkSession(b *testing.B) *gocql.Session {
+	b.Helper()
+	hosts := os.Getenv("CASSANDRA_HOSTS")
+	if hosts == "" {
+		b.Skip("CASSANDRA_HOSTS isn't set")
+	}
+
+	benchmarkOnce.Do(func() {
+		cfg := config.CassandraConfig{
+			CassandraHosts:          strings.Split(hosts, ","),
+			CassandraConsistency:    gocql.One,
+			CassandraTimeout:        11 * time.Second,
+			CassandraConnectTimeout: 11 * time.Second,
+		}
+		var session *gocql.Session
+		if session, benchmarkErr = cassandra.NewSession(cfg); benchmarkErr != nil {
+			return
+		}
+		if benchmarkErr = createBenchmarkSchema(session); benchmarkErr != nil {
+			session.Close()
+			return
+		}
+		session.Close()
+
+		cfg.Keyspace = benchmarkKeyspace
+		if benchmarkSession, benchmarkErr = cassandra.NewSession(cfg); benchmarkErr != nil {
+			return
+		}
+		benchmarkErr = insertBenchmarkLoans(benchmarkSession)
+	})
+	if benchmarkErr != nil {
+		b.Fatalf("failed to set up benchmark keyspace: %v", benchmarkErr)
+	}
+	return benchmarkSession
+}
+
+func createBenchmarkSchema(session *gocql.Session) error {
+	statements := []string{
+		`DROP KEYSPACE IF EXISTS ` + benchmarkKeyspace,
+		`CREATE KEYSPACE ` + benchmarkKeyspace + ` WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}`,
+		`CREATE TABLE ` + benchmarkKeyspace + `.loans (
+			borrower_id uuid,
+			due_date timestamp,
+			book_id uuid,
+			borrower_name text,
+			borrower_email text,
+			borrower_language text,
+			book_title text,
+			book_author text,
+			due_soon_notification_sent boolean,
+			PRIMARY KEY (borrower_id, due_date, book_id)
+		)`,
+		`CREATE CUSTOM INDEX loans_by_due_date ON ` + benchmarkKeyspace + `.loans(due_date) USING 'StorageAttachedIndex'`,
+		`CREATE CUSTOM INDEX loans_by_notification_status ON ` + benchmarkKeyspace + `.loans(due_soon_notification_sent) USING 'StorageAttachedIndex'`,
+		`CREATE TABLE ` + benchmarkKeyspace + `.loans_by_due_day (
+			due_day date,
+			borrower_id uuid,
+			book_id uuid,
+			due_date timestamp,
+			borrower_name text,
+			borrower_email text,
+			borrower_language text,
+			book_title text,
+			book_author text,
+			due_soon_notification_sent boolean,
+			PRIMARY KEY (due_day, borrower_id, book_id)
+		)`,
+	}
+	for _, statement := range statements {
+		if err := session.Query(statement).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertBenchmarkLoans(session *gocql.Session) error {
+	for day := 0; day < benchmarkDays; day++ {
+		dueDate := benchmarkStart.AddDate(0, 0, day)
+		for i := 0; i < benchmarkLoansPerDay; i++ {
+			borrowerID, bookID := gocql.TimeUUID(), gocql.TimeUUID()
+			notified := i%4 == 0
+			batch := session.NewBatch(gocql.LoggedBatch)
+			batch.Query(
+				`INSERT INTO loans (
+					borrower_id, due_date, book_id,
+					borrower_name, borrower_email, borrower_language,
+					book_title, book_author, due_soon_notification_sent
+				) VALUES (?, ?, ?, 'Borrower', 'borrower@example.com', 'en', 'Title', 'Author', ?)`,
+				borrowerID, dueDate, bookID, notified,
+			)
+			batch.Query(
+				`INSERT INTO loans_by_due_day (
+					due_day, borrower_id, book_id, due_date,
+					borrower_name, borrower_email, borrower_language,
+					book_title, book_author, due_soon_notification_sent
+				) VALUES (?, ?, ?, ?, 'Borrower', 'borrower@example.com', 'en', 'Title', 'Author', ?)`,
+				dueDate.Format(time.DateOnly), borrowerID, bookID, dueDate, notified,
+			)
+			if err := session.ExecuteBatch(batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BenchmarkDueLoansByDueDay reads a day's partition, as checkDueDay does
+func BenchmarkDueLoansByDueDay(b *testing.B) {
+	session := dueLoansBenchmarkSession(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		day := benchmarkStart.AddDate(0, 0, i%benchmarkDays)
+		iter := session.Query(
+			`SELECT borrower_id, due_date, book_id,
+			        borrower_name, borrower_email, borrower_language,
+			        book_title, book_author,
+			        due_soon_notification_sent
+			 FROM loans_by_due_day
+			 WHERE due_day = ?`,
+			day.Format(time.DateOnly),
+		).PageSize(dueLoansPageSize).Iter()
+		readBenchmarkLoans(b, iter)
+	}
+}
+
+// BenchmarkDueLoansBySAIIndexes queries the loans table through the indexes, as the due soon check did before loans by
+// due day was added
+func BenchmarkDueLoansBySAIIndexes(b *testing.B) {
+	session := dueLoansBenchmarkSession(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		day := benchmarkStart.AddDate(0, 0, i%benchmarkDays)
+		iter := session.Query(
+			`SELECT borrower_id, due_date, book_id,
+			        borrower_name, borrower_email, borrower_language,
+			        book_title, book_author,
+			        due_soon_notification_sent
+			 FROM loans
+			 WHERE due_date = ?
+			   AND due_soon_notification_sent = false`,
+			day,
+		).PageSize(dueLoansPageSize).Iter()
+		readBenchmarkLoans(b, iter)
+	}
+}
+
+// readBenchmarkLoans reads the unnotified loans from iter, failing the benchmark unless it finds every one
+func readBenchmarkLoans(b *testing.B, iter *gocql.Iter) {
+	b.Helper()
+	var (
+		loan             Loan
+		notificationSent bool
+		unnotified       int
+	)
+	for iter.Scan(
+		&loan.BorrowerID, &loan.DueDate, &loan.BookID,
+		&loan.BorrowerName, &loan.BorrowerEmail, &loan.BorrowerLanguage,
+		&loan.BookTitle, &loan.BookAuthor,
+		&notificationSent,
+	) {
+		if !notificationSent {
+			unnotified++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if want := benchmarkLoansPerDay * 3 / 4; unnotified != want {
+		b.Fatalf("found %d unnotified loans, want %d", unnotified, want)
+	}
+}
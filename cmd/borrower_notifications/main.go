@@ -2,18 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/gocql/gocql"
 	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
 	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/email"
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+	"github.com/mattgallagher92/library-book-tracker/internal/leader"
+	"github.com/mattgallagher92/library-book-tracker/internal/lifecycle"
+	"github.com/mattgallagher92/library-book-tracker/internal/notifications"
+	"github.com/mattgallagher92/library-book-tracker/internal/simclock"
+	"github.com/mattgallagher92/library-book-tracker/internal/sms"
 	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
 	borrowernotificationv1 "github.com/mattgallagher92/library-book-tracker/proto/borrower_notification/v1"
+	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
@@ -26,102 +42,569 @@ type Loan struct {
 	BookID        gocql.UUID
 	BorrowerName  string
 	BorrowerEmail string
-	BookTitle     string
-	BookAuthor    string
+	// BorrowerLanguage is empty for loans created before borrowers had a preferred language
+	BorrowerLanguage string
+	BookTitle        string
+	BookAuthor       string
 }
 
-func checkDueLoans(session *gocql.Session, provider timeProvider.Provider, producer sarama.SyncProducer, codec *goavro.Codec) error {
-	now := provider.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	twoDaysFromNow := today.AddDate(0, 0, 2)
+// dueSoonIdempotencyKey identifies the due soon notification for a borrower's loans, so that the email and SMS services
+// can skip duplicate commands (e.g. if the service restarts after publishing a command but before marking the loans).
+// The key for a digest depends on which books it lists, so a book left unmarked by a partial failure is included in a
+// later digest rather than being skipped as a duplicate.
+func dueSoonIdempotencyKey(loans []Loan) string {
+	first := loans[0]
+	if len(loans) == 1 {
+		return fmt.Sprintf("due-soon:%s:%s:%s", first.BorrowerID, first.BookID, first.DueDate.Format(time.DateOnly))
+	}
+
+	bookIDs := make([]string, len(loans))
+	for i, loan := range loans {
+		bookIDs[i] = loan.BookID.String()
+	}
+	sort.Strings(bookIDs)
+	hash := sha256.Sum256([]byte(strings.Join(bookIDs, ",")))
+	return fmt.Sprintf("due-soon-digest:%s:%s:%x", first.BorrowerID, first.DueDate.Format(time.DateOnly), hash[:8])
+}
+
+// dueLoansPageSize is the number of loans fetched from Cassandra at a time when checking for due loans
+const dueLoansPageSize = 500
+
+// dueLoanCheckSummary describes what a due loan check did
+type dueLoanCheckSummary struct {
+	DaysChecked int
+	// LoansMatched is the number of loans found that hadn't been notified
+	LoansMatched int
+	// LoansNotified is the number of loans that have been notified, or skipped because the borrower opted out
+	LoansNotified     int
+	CommandsPublished int
+	// Failures is the number of notifications that couldn't be sent or recorded; they are retried by later checks
+	Failures int
+}
+
+func (s *dueLoanCheckSummary) add(other dueLoanCheckSummary) {
+	s.DaysChecked += other.DaysChecked
+	s.LoansMatched += other.LoansMatched
+	s.LoansNotified += other.LoansNotified
+	s.CommandsPublished += other.CommandsPublished
+	s.Failures += other.Failures
+}
+
+// dueLoanChecker stops the periodic check and checks requested via gRPC from running at the same time
+type dueLoanChecker struct {
+	session        *gocql.Session
+	producer       sarama.SyncProducer
+	codecs         commandCodecs
+	maxCatchUpDays int
+	// location is the library's time zone, which days are checked in
+	location *time.Location
+
+	mu sync.Mutex
+}
+
+// check checks for loans due soon after asOf, which is usually now, until ctx is cancelled, which it should be as
+// soon as this replica stops being leader
+func (c *dueLoanChecker) check(ctx context.Context, now time.Time, asOf time.Time) (dueLoanCheckSummary, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return checkDueLoans(ctx, c.session, now.In(c.location), asOf.In(c.location), c.producer, c.codecs, c.maxCatchUpDays)
+}
 
-	log.Printf("Checking for loans due on %s", twoDaysFromNow.Format(time.RFC3339))
-	// Query for loans due in 2 days that haven't been notified
+// checkDueLoans sends due soon notifications for loans due two open days after asOf, counting only days that the
+// library is open. It also catches up on days missed since the last check that every loan was notified for, e.g.
+// because the service was down or simulated time jumped forward, as described by catchUpWindow. Quiet hours are
+// checked at now, and days are in now's location. It stops between days and between borrowers once ctx is cancelled.
+func checkDueLoans(ctx context.Context, session *gocql.Session, now time.Time, asOf time.Time, producer sarama.SyncProducer, codecs commandCodecs, maxCatchUpDays int) (dueLoanCheckSummary, error) {
+	var summary dueLoanCheckSummary
+	cal, err := calendar.Load(session)
+	if err != nil {
+		return summary, fmt.Errorf("failed to load calendar: %w", err)
+	}
+	watermark, err := loadWatermark(session, dueSoonWatermark, now.Location())
+	if err != nil {
+		return summary, fmt.Errorf("failed to load watermark: %w", err)
+	}
+	from, horizon, watermarkLimit := catchUpWindow(cal, now, asOf, watermark, maxCatchUpDays)
+
+	// The watermark only advances past a day once every loan due that day has been notified, so that loans deferred
+	// by quiet hours or failures are retried by later checks
+	advancing := true
+	backfilled := 0
+	for day := from; !day.After(horizon); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return summary, fmt.Errorf("stopped before checking loans due on %s: %w", day.Format(time.DateOnly), err)
+		}
+		daySummary, complete, err := checkDueDay(ctx, session, now, day, producer, codecs)
+		summary.add(daySummary)
+		if err != nil {
+			return summary, err
+		}
+		if day.Before(horizon) {
+			backfilled += daySummary.LoansNotified
+		}
+
+		advancing = advancing && complete
+		if advancing && day.After(watermark) && !day.After(watermarkLimit) {
+			if err := saveWatermark(session, dueSoonWatermark, day); err != nil {
+				return summary, fmt.Errorf("failed to save watermark: %w", err)
+			}
+			watermark = day
+		}
+	}
+	if from.Before(horizon) {
+		log.Printf("Caught up on loans due from %s to %s; backfilled %d loan(s)",
+			from.Format(time.DateOnly), horizon.AddDate(0, 0, -1).Format(time.DateOnly), backfilled)
+	}
+
+	return summary, nil
+}
+
+// catchUpWindow returns the due days that a check as of asOf checks, from from to horizon, which is two open days
+// after asOf, and the latest day that it may move the watermark to. Loans due on closed days in between, e.g. from
+// before the calendar was set up, are checked too. The check starts the day after the watermark, so that days missed
+// since the last complete check are caught up on, but never before today, as loans due before today are already
+// overdue rather than due soon; the periodic check is therefore never more than its horizon behind. A check as of a
+// later date than now can be much further ahead of the watermark, so it only catches up on the maxCatchUpDays days
+// before its horizon, and mustn't move the watermark past the days due soon as of now, so that the periodic check
+// still catches up on them.
+func catchUpWindow(cal *calendar.Calendar, now, asOf, watermark time.Time, maxCatchUpDays int) (from, horizon, watermarkLimit time.Time) {
+	today := calendar.StartOfDay(now, now.Location())
+	asOfDay := calendar.StartOfDay(asOf, now.Location())
+	horizon = cal.AddOpenDays(asOfDay, 2)
+	watermarkLimit = cal.AddOpenDays(today, 2)
+
+	from = horizon
+	if !watermark.IsZero() && watermark.Before(horizon) {
+		from = watermark.AddDate(0, 0, 1)
+	}
+	if earliest := horizon.AddDate(0, 0, -maxCatchUpDays); asOfDay.After(today) && from.Before(earliest) {
+		log.Printf("Last checked loans due on %s; only catching up from %s",
+			watermark.Format(time.DateOnly), earliest.Format(time.DateOnly))
+		from = earliest
+	}
+	if from.Before(today) {
+		log.Printf("Not checking loans due from %s to %s because they are overdue",
+			from.Format(time.DateOnly), today.AddDate(0, 0, -1).Format(time.DateOnly))
+		from = today
+	}
+	return from, horizon, watermarkLimit
+}
+
+// checkDueDay sends due soon notifications for loans due on day that haven't been notified. It also returns whether
+// every loan due that day has now been notified.
+func checkDueDay(ctx context.Context, session *gocql.Session, now time.Time, day time.Time, producer sarama.SyncProducer, codecs commandCodecs) (dueLoanCheckSummary, bool, error) {
+	summary := dueLoanCheckSummary{DaysChecked: 1}
+	log.Printf("Checking for loans due on %s", day.Format(time.RFC3339))
+	// Read the day's partition a page at a time; gocql fetches the next page as the iterator reaches the end of each
 	upcomingLoans := session.Query(
-		`SELECT borrower_id, due_date, book_id, 
-		        borrower_name, borrower_email,
+		`SELECT borrower_id, due_date, book_id,
+		        borrower_name, borrower_email, borrower_language,
 		        book_title, book_author,
 		        due_soon_notification_sent
-		 FROM loans 
-		 WHERE due_date = ? 
-		   AND due_soon_notification_sent = false`,
-		twoDaysFromNow,
-	).Iter()
-	log.Printf("Found at least %d unnotified loans due on %s", upcomingLoans.NumRows(), twoDaysFromNow.Format(time.RFC3339))
+		 FROM loans_by_due_day
+		 WHERE due_day = ?`,
+		day.Format(time.DateOnly),
+	).WithContext(ctx).PageSize(dueLoansPageSize).Idempotent(true).Iter()
 
+	// Group the loans by borrower so that each borrower gets one notification listing all of their books. Rows are
+	// clustered by borrower, so each borrower's loans are adjacent.
 	var (
 		loan             Loan
 		notificationSent bool
+		borrowerIDs      []gocql.UUID
+		loansByBorrower  = map[gocql.UUID][]Loan{}
+		unnotified       int
 	)
 	for upcomingLoans.Scan(
 		&loan.BorrowerID, &loan.DueDate, &loan.BookID,
-		&loan.BorrowerName, &loan.BorrowerEmail,
+		&loan.BorrowerName, &loan.BorrowerEmail, &loan.BorrowerLanguage,
 		&loan.BookTitle, &loan.BookAuthor,
 		&notificationSent,
 	) {
-		// Create email command
-		emailBody := "Dear " + loan.BorrowerName + ",\n\n" +
-			"This is a reminder that '" + loan.BookTitle + "' by " + loan.BookAuthor +
-			" is due on " + loan.DueDate.Format("2006-01-02") + ".\n\n" +
-			"Kind regards,\nLibrary System"
+		if notificationSent {
+			continue
+		}
+		// Timestamps are read in UTC, but due dates are midnight in the library's local time
+		loan.DueDate = loan.DueDate.In(now.Location())
+		if _, ok := loansByBorrower[loan.BorrowerID]; !ok {
+			borrowerIDs = append(borrowerIDs, loan.BorrowerID)
+		}
+		loansByBorrower[loan.BorrowerID] = append(loansByBorrower[loan.BorrowerID], loan)
+		unnotified++
+	}
+	if err := upcomingLoans.Close(); err != nil {
+		return summary, false, err
+	}
+	log.Printf("Found %d unnotified loans due on %s", unnotified, day.Format(time.RFC3339))
+	summary.LoansMatched = unnotified
 
-		// Create Avro record
-		native := map[string]interface{}{
-			"toAddress": loan.BorrowerEmail,
-			"subject":   "Library Book Due Soon: " + loan.BookTitle,
-			"body":      emailBody,
+	for _, borrowerID := range borrowerIDs {
+		if err := ctx.Err(); err != nil {
+			return summary, false, fmt.Errorf("stopped checking loans due on %s: %w", day.Format(time.DateOnly), err)
+		}
+		loans := loansByBorrower[borrowerID]
+		result := notifyDueSoon(session, now, producer, codecs, loans)
+		if result.published {
+			summary.CommandsPublished++
 		}
+		if result.complete {
+			summary.LoansNotified += len(loans)
+		}
+		if result.failed {
+			summary.Failures++
+		}
+	}
+	return summary, summary.LoansNotified == unnotified, nil
+}
 
-		// Serialize the record
-		binary, err := codec.BinaryFromNative(nil, native)
-		if err != nil {
-			log.Printf("Failed to serialize email command: %v", err)
-			continue
+// notifyResult describes what happened when notifying a borrower of their loans
+type notifyResult struct {
+	published bool
+	// complete is whether every loan has been marked, so won't be considered again
+	complete bool
+	failed   bool
+}
+
+// notifyDueSoon sends one due soon notification for a borrower's loans that are due on the same day, marking each
+// loan once the notification has been published
+func notifyDueSoon(session *gocql.Session, now time.Time, producer sarama.SyncProducer, codecs commandCodecs, loans []Loan) notifyResult {
+	borrower := loans[0]
+
+	prefs, err := loadPreferences(session, borrower.BorrowerID)
+	if err != nil {
+		log.Printf("Failed to load notification preferences for borrower %s: %v", borrower.BorrowerID, err)
+		return notifyResult{failed: true}
+	}
+	if !prefs.Allows(NotificationTypeDueSoon) {
+		// Mark the loans so that they aren't considered again; the borrower doesn't want this notification
+		log.Printf("Borrower %s has opted out of due soon notifications; skipping %d book(s)", borrower.BorrowerID, len(loans))
+		marked := markDueSoonNotificationsSent(session, loans)
+		return notifyResult{complete: marked, failed: !marked}
+	}
+
+	bookIDs := make([]string, len(loans))
+	bookTitles := make([]string, len(loans))
+	items := make([]map[string]string, len(loans))
+	for i, loan := range loans {
+		bookIDs[i] = loan.BookID.String()
+		bookTitles[i] = loan.BookTitle
+		items[i] = map[string]string{
+			"bookTitle":  loan.BookTitle,
+			"bookAuthor": loan.BookAuthor,
+			"dueDate":    loan.DueDate.Format(time.DateOnly),
 		}
+	}
 
-		// Send to Kafka
-		_, _, err = producer.SendMessage(&sarama.ProducerMessage{
-			Topic: "send-email-command",
-			Value: sarama.ByteEncoder(binary),
-		})
-		if err != nil {
-			log.Printf("Failed to send email command to Kafka: %v", err)
-			continue
+	idempotencyKey := dueSoonIdempotencyKey(loans)
+	notification := Notification{
+		ID:            notifications.IDFromKey(idempotencyKey),
+		RecipientID:   borrower.BorrowerID,
+		RecipientType: recipientTypeBorrower,
+		Type:          NotificationTypeDueSoon,
+		Channel:       prefs.Channel,
+		Details: map[string]string{
+			"book_ids":    strings.Join(bookIDs, ","),
+			"book_titles": strings.Join(bookTitles, "; "),
+			"due_date":    borrower.DueDate.Format(time.DateOnly),
+		},
+		CreatedAt: now,
+	}
+	if err := createNotification(session, notification); err != nil {
+		log.Printf("Failed to record due soon notification for borrower %s: %v", borrower.BorrowerID, err)
+		return notifyResult{failed: true}
+	}
+
+	if prefs.QuietHours.Contains(now) {
+		// Leave the loans unmarked so that a later check sends the notification once quiet hours are over
+		log.Printf("Borrower %s is in quiet hours; deferring notification for %d book(s)", borrower.BorrowerID, len(loans))
+		return notifyResult{}
+	}
+	channel := prefs.Channel
+	var phoneNumber string
+	if channel == ChannelSMS {
+		if phoneNumber, err = loadPhoneNumber(session, borrower.BorrowerID); err != nil {
+			log.Printf("Failed to load phone number for borrower %s: %v", borrower.BorrowerID, err)
+			return notifyResult{failed: true}
+		}
+		if phoneNumber == "" {
+			log.Printf("Borrower %s prefers SMS but has no phone number; notifying by email instead", borrower.BorrowerID)
+			channel = ChannelEmail
 		}
+	}
+
+	locale := borrower.BorrowerLanguage
+	if locale == "" {
+		locale = i18n.DefaultLocale
+	}
+
+	cmd := notificationCommand{
+		templateID: email.TemplateDueSoon,
+		locale:     locale,
+		parameters: map[string]interface{}{
+			"borrowerName": borrower.BorrowerName,
+			"bookTitle":    borrower.BookTitle,
+			"bookAuthor":   borrower.BookAuthor,
+			"dueDate":      borrower.DueDate.Format(time.DateOnly),
+		},
+		idempotencyKey: idempotencyKey,
+		notificationID: notification.ID.String(),
+		recipientID:    borrower.BorrowerID.String(),
+	}
+	if len(loans) > 1 {
+		cmd.templateID = email.TemplateDueSoonDigest
+		cmd.parameters = map[string]interface{}{
+			"borrowerName": borrower.BorrowerName,
+		}
+		cmd.items = items
+	}
+	if channel == ChannelSMS {
+		err = publishSmsCommand(producer, codecs.sms, phoneNumber, cmd)
+	} else {
+		err = publishEmailCommand(producer, codecs.email, borrower.BorrowerEmail, cmd)
+	}
+	if err != nil {
+		log.Printf("Failed to publish due soon notification for borrower %s: %v", borrower.BorrowerID, err)
+		return notifyResult{failed: true}
+	}
 
-		// Mark notification as sent
-		if err := session.Query(
+	if err := markNotificationQueued(session, notification, channel, now); err != nil {
+		// The command has been published, so only the status shown to staff is affected
+		log.Printf("Failed to mark notification %s as queued: %v", notification.ID, err)
+	}
+
+	marked := markDueSoonNotificationsSent(session, loans)
+	return notifyResult{published: true, complete: marked, failed: !marked}
+}
+
+// commandCodecs contains the codecs for the commands that notifications are sent with
+type commandCodecs struct {
+	email *email.CommandCodec
+	sms   *goavro.Codec
+}
+
+// notificationCommand contains the fields common to send email and send SMS commands; the email and SMS services
+// render the message from the template
+type notificationCommand struct {
+	templateID string
+	locale     string
+	parameters map[string]interface{}
+	// items are repeated values, e.g. the books listed in a digest
+	items          []map[string]string
+	idempotencyKey string
+	notificationID string
+	recipientID    string
+}
+
+// itemsNative converts the items to the representation expected by goavro
+func (cmd notificationCommand) itemsNative() []interface{} {
+	native := make([]interface{}, len(cmd.items))
+	for i, item := range cmd.items {
+		nativeItem := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			nativeItem[k] = v
+		}
+		native[i] = nativeItem
+	}
+	return native
+}
+
+func publishEmailCommand(producer sarama.SyncProducer, codec *email.CommandCodec, toAddress string, cmd notificationCommand) error {
+	// Create Avro record
+	native := map[string]interface{}{
+		"toAddress":      toAddress,
+		"templateId":     cmd.templateID,
+		"locale":         cmd.locale,
+		"parameters":     cmd.parameters,
+		"items":          cmd.itemsNative(),
+		"idempotencyKey": cmd.idempotencyKey,
+		"notificationId": cmd.notificationID,
+		"recipientId":    cmd.recipientID,
+	}
+	binary, err := codec.Encode(native)
+	if err != nil {
+		return fmt.Errorf("failed to serialize command: %w", err)
+	}
+	return publishCommand(producer, email.CommandTopic, binary)
+}
+
+func publishSmsCommand(producer sarama.SyncProducer, codec *goavro.Codec, toNumber string, cmd notificationCommand) error {
+	// Create Avro record
+	native := map[string]interface{}{
+		"toNumber":       toNumber,
+		"templateId":     cmd.templateID,
+		"locale":         cmd.locale,
+		"parameters":     cmd.parameters,
+		"items":          cmd.itemsNative(),
+		"idempotencyKey": cmd.idempotencyKey,
+		"notificationId": cmd.notificationID,
+		"recipientId":    cmd.recipientID,
+	}
+	binary, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return fmt.Errorf("failed to serialize command: %w", err)
+	}
+	return publishCommand(producer, sms.CommandTopic, binary)
+}
+
+func publishCommand(producer sarama.SyncProducer, topic string, binary []byte) error {
+	// Send to Kafka
+	if _, _, err := producer.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(binary),
+	}); err != nil {
+		return fmt.Errorf("failed to send command to Kafka: %w", err)
+	}
+	return nil
+}
+
+// loadPhoneNumber returns the borrower's phone number, or the empty string if they don't have one
+func loadPhoneNumber(session *gocql.Session, borrowerID gocql.UUID) (string, error) {
+	var phoneNumber string
+	if err := session.Query(
+		`SELECT phone_number FROM borrower WHERE id = ?`,
+		borrowerID,
+	).Idempotent(true).Scan(&phoneNumber); err != nil && err != gocql.ErrNotFound {
+		return "", err
+	}
+	return phoneNumber, nil
+}
+
+// markDueSoonNotificationsSent marks each loan individually, so that a loan that fails to be marked is included in the
+// next notification. It returns whether every loan was marked.
+func markDueSoonNotificationsSent(session *gocql.Session, loans []Loan) bool {
+	marked := true
+	for _, loan := range loans {
+		batch := session.NewBatch(gocql.LoggedBatch)
+		batch.Query(
 			`UPDATE loans 
 			 SET due_soon_notification_sent = true 
 			 WHERE borrower_id = ? AND due_date = ? AND book_id = ?`,
 			loan.BorrowerID, loan.DueDate, loan.BookID,
-		).Exec(); err != nil {
-			log.Printf("Failed to mark notification as sent: %v", err)
+		)
+		batch.Query(
+			`UPDATE loans_by_due_day
+			 SET due_soon_notification_sent = true
+			 WHERE due_day = ? AND borrower_id = ? AND book_id = ?`,
+			loan.DueDate.Format(time.DateOnly), loan.BorrowerID, loan.BookID,
+		)
+		if err := session.ExecuteBatch(cassandra.MarkIdempotent(batch)); err != nil {
+			log.Printf("Failed to mark notification as sent for book %s: %v", loan.BookID, err)
+			marked = false
 		}
 	}
-
-	return upcomingLoans.Close()
+	return marked
 }
 
 type notificationServer struct {
 	borrowernotificationv1.UnimplementedBorrowerNotificationServiceServer
+	session      *gocql.Session
 	timeProvider timeProvider.Provider
+	checker      *dueLoanChecker
+	elector      *leader.Elector
 }
 
-func (s *notificationServer) UpdateSimulatedTime(ctx context.Context, req *borrowernotificationv1.UpdateSimulatedTimeRequest) (*borrowernotificationv1.UpdateSimulatedTimeResponse, error) {
-	if provider, ok := s.timeProvider.(*timeProvider.SimulatedProvider); ok {
-		t, err := time.Parse(time.RFC3339, req.Timestamp)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid timestamp format: %v", err)
+func (s *notificationServer) GetPreferences(ctx context.Context, req *borrowernotificationv1.GetPreferencesRequest) (*borrowernotificationv1.GetPreferencesResponse, error) {
+	borrowerID, err := gocql.ParseUUID(req.BorrowerId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid borrower ID: %v", err)
+	}
+
+	prefs, err := loadPreferences(s.session, borrowerID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load preferences: %v", err)
+	}
+
+	return &borrowernotificationv1.GetPreferencesResponse{
+		Preferences: preferencesToProto(prefs),
+	}, nil
+}
+
+func (s *notificationServer) UpdatePreferences(ctx context.Context, req *borrowernotificationv1.UpdatePreferencesRequest) (*borrowernotificationv1.UpdatePreferencesResponse, error) {
+	borrowerID, err := gocql.ParseUUID(req.BorrowerId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid borrower ID: %v", err)
+	}
+
+	prefs, err := preferencesFromProto(req.Preferences)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid preferences: %v", err)
+	}
+
+	if err := savePreferences(s.session, borrowerID, prefs); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save preferences: %v", err)
+	}
+	log.Printf("Updated notification preferences for borrower %s", borrowerID)
+
+	return &borrowernotificationv1.UpdatePreferencesResponse{}, nil
+}
+
+func (s *notificationServer) ListNotifications(ctx context.Context, req *borrowernotificationv1.ListNotificationsRequest) (*borrowernotificationv1.ListNotificationsResponse, error) {
+	borrowerID, err := gocql.ParseUUID(req.BorrowerId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid borrower ID: %v", err)
+	}
+
+	list, err := listNotifications(s.session, borrowerID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list notifications: %v", err)
+	}
+
+	resp := &borrowernotificationv1.ListNotificationsResponse{}
+	for _, n := range list {
+		resp.Notifications = append(resp.Notifications, notificationToProto(n))
+	}
+	return resp, nil
+}
+
+func (s *notificationServer) RunDueLoanCheck(ctx context.Context, req *borrowernotificationv1.RunDueLoanCheckRequest) (*borrowernotificationv1.RunDueLoanCheckResponse, error) {
+	// Another replica may be checking at the same time, which would send duplicate notifications
+	if !s.elector.IsLeader() {
+		return nil, status.Error(codes.FailedPrecondition, "this replica is not the leader; retry to reach another replica")
+	}
+	leaderCtx, cancel := s.elector.LeaderContext(ctx)
+	defer cancel()
+
+	now := s.timeProvider.Now().In(s.checker.location)
+	asOf := now
+	if req.AsOfDate != "" {
+		var err error
+		if asOf, err = time.ParseInLocation(time.DateOnly, req.AsOfDate, now.Location()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid as of date: %v", err)
+		}
+	}
+
+	log.Printf("Running due loan check as of %s on request", asOf.Format(time.DateOnly))
+	summary, err := s.checker.check(leaderCtx, now, asOf)
+	if err != nil {
+		if leaderCtx.Err() != nil && ctx.Err() == nil {
+			return nil, status.Errorf(codes.Aborted, "stopped checking due loans because this replica stopped being leader: %v", err)
 		}
-		provider.SetTime(t)
-		return &borrowernotificationv1.UpdateSimulatedTimeResponse{}, nil
+		return nil, status.Errorf(codes.Internal, "failed to check due loans: %v", err)
+	}
+
+	return &borrowernotificationv1.RunDueLoanCheckResponse{
+		DaysChecked:       int32(summary.DaysChecked),
+		LoansMatched:      int32(summary.LoansMatched),
+		LoansNotified:     int32(summary.LoansNotified),
+		CommandsPublished: int32(summary.CommandsPublished),
+		Failures:          int32(summary.Failures),
+	}, nil
+}
+
+func loadCodec(schemaPath string) *goavro.Codec {
+	schemaFile, err := os.ReadFile(schemaPath)
+	if err != nil {
+		log.Fatalf("Failed to read Avro schema: %v", err)
+	}
+	codec, err := goavro.NewCodec(string(schemaFile))
+	if err != nil {
+		log.Fatalf("Failed to parse Avro schema: %v", err)
 	}
-	return nil, status.Error(codes.FailedPrecondition, "time simulation not enabled")
+	return codec
 }
 
 func main() {
-	checkInterval := flag.Int("interval", 300, "Interval between checks in seconds")
+	checkInterval := flag.Int("interval", 300, "Interval between checks in seconds, of simulated time if SIMULATE_TIME is true")
 	flag.Parse()
 
 	log.Println("Borrower notification service starting...")
@@ -133,93 +616,150 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize Cassandra cluster config
-	cluster := gocql.NewCluster(cfg.CassandraHosts...)
-	cluster.Keyspace = cfg.Keyspace
-	cluster.Consistency = gocql.Quorum
+	// Shut down cleanly on SIGTERM, so that a due loan check isn't cut off mid-sweep when a pod is replaced
+	service := lifecycle.New(cfg.ShutdownTimeout)
 
-	// Create session
-	session, err := cluster.CreateSession()
+	// Create Cassandra session
+	session, err := cassandra.NewSession(cfg.CassandraConfig)
 	if err != nil {
 		log.Fatalf("Failed to create Cassandra session: %v", err)
 	}
-	defer session.Close()
+	service.OnClose("Cassandra session", func() error {
+		session.Close()
+		return nil
+	})
 
 	log.Println("Connected to Cassandra")
 
-	// Load and parse Avro schema
-	schemaFile, err := os.ReadFile("schemas/avro/commands/send_email.avsc")
+	// Load and parse Avro schemas
+	emailCodec, err := email.LoadCommandCodec()
 	if err != nil {
-		log.Fatalf("Failed to read Avro schema: %v", err)
+		log.Fatalf("Failed to load send email command Avro schemas: %v", err)
 	}
-	codec, err := goavro.NewCodec(string(schemaFile))
-	if err != nil {
-		log.Fatalf("Failed to parse Avro schema: %v", err)
+	codecs := commandCodecs{
+		email: emailCodec,
+		sms:   loadCodec("schemas/avro/commands/send_sms.avsc"),
 	}
 
 	// Configure Kafka producer
-	kafkaConfig := sarama.NewConfig()
-	kafkaConfig.Producer.Return.Successes = true
-	kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
-	kafkaConfig.Producer.Retry.Max = 5
-
-	producer, err := sarama.NewSyncProducer(cfg.KafkaBrokers, kafkaConfig)
+	producer, err := kafka.NewSyncProducer(cfg.KafkaConfig)
 	if err != nil {
 		log.Fatalf("Failed to create Kafka producer: %v", err)
 	}
-	defer producer.Close()
+	service.OnClose("Kafka producer", producer.Close)
 
 	// Initialize time provider
 	var tp timeProvider.Provider
-	if os.Getenv("SIMULATE_TIME") == "true" {
+	if cfg.SimulateTime {
 		log.Println("Using simulated time")
-		tp = timeProvider.NewSimulatedProvider(time.Now())
+		simulated := timeProvider.NewSimulatedProvider(time.Now())
+		timeProvider.Receive(service.Context(), cfg.SimulatedTimeConfig, timev1.ClientKind_CLIENT_KIND_BORROWER_NOTIFICATIONS, simulated)
+		tp = simulated
 	} else {
 		log.Println("Using actual system time")
 		tp = &timeProvider.RealProvider{}
 	}
 
+	checker := &dueLoanChecker{
+		session:        session,
+		producer:       producer,
+		codecs:         codecs,
+		maxCatchUpDays: cfg.MaxCatchUpDays,
+		location:       cfg.TimeZone,
+	}
+	elector := &leader.Elector{
+		Session: session,
+		Name:    "borrower-notifications-due-loan-check",
+		Holder:  cfg.InstanceID,
+		TTL:     cfg.LeaseTTL,
+	}
+
 	// Create gRPC server
 	server := grpc.NewServer()
 	notificationSrv := &notificationServer{
+		session:      session,
 		timeProvider: tp,
+		checker:      checker,
+		elector:      elector,
 	}
 	borrowernotificationv1.RegisterBorrowerNotificationServiceServer(server, notificationSrv)
+	simclock.Register(server, tp)
 
 	// Start listening for gRPC requests
-	lis, err := net.Listen("tcp", ":50053")
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	// Enable reflection in development mode
-	if os.Getenv("ENV") != "production" {
+	if cfg.Env != config.EnvProduction {
 		reflection.Register(server)
 		log.Println("gRPC reflection enabled for development")
 	}
 
-	log.Printf("gRPC server listening on :50053")
+	log.Printf("gRPC server listening on :%d", cfg.Port)
 
-	// Start notification checker in a goroutine
-	go func() {
-		ticker := time.NewTicker(time.Duration(*checkInterval) * time.Second)
-		defer ticker.Stop()
+	// Track notifications as the email and SMS services send them
+	statusCodec, err := notifications.LoadStatusCodec("schemas/avro/events/notification_status_changed.avsc")
+	if err != nil {
+		log.Fatalf("Failed to load notification status Avro schema: %v", err)
+	}
 
-		// Do an initial check immediately
-		if err := checkDueLoans(session, tp, producer, codec); err != nil {
-			log.Printf("Error checking due loans: %v", err)
+	group, err := kafka.NewConsumerGroup(cfg.KafkaConfig, "borrower-notifications", sarama.OffsetOldest)
+	if err != nil {
+		log.Fatalf("Failed to create consumer group: %v", err)
+	}
+	service.OnClose("Kafka consumer group", group.Close)
+
+	service.Go(func(ctx context.Context) {
+		handler := &statusHandler{session: session, timeProvider: tp, codec: statusCodec}
+		for {
+			err := group.Consume(ctx, []string{notifications.StatusTopic}, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Error from notification status consumer: %v", err)
+				time.Sleep(time.Second)
+			}
 		}
+	})
+
+	// Only the replica holding the lease checks for due loans, so that replicas don't send duplicate notifications.
+	// The elector releases the lease on shutdown so that another replica can take over straight away.
+	elector.TryAcquire()
+	service.Go(elector.Run)
+
+	// Start notification checker in the background. Its ticker follows simulated time, so when time is simulated
+	// checks run as the time service moves time forward rather than as real time passes. A check that has started
+	// stops at the next borrower on shutdown, before the Cassandra session and Kafka producer are closed.
+	service.Go(func(ctx context.Context) {
+		ticker := tp.NewTicker(time.Duration(*checkInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			if elector.IsLeader() {
+				// Stop part way through if this replica loses the lease or starts shutting down, so that the check
+				// doesn't overlap with the next leader's
+				leaderCtx, cancel := elector.LeaderContext(ctx)
+				now := tp.Now()
+				if _, err := checker.check(leaderCtx, now, now); err != nil {
+					log.Printf("Error checking due loans: %v", err)
+				}
+				cancel()
+			}
 
-		// Then check periodically
-		for range ticker.C {
-			if err := checkDueLoans(session, tp, producer, codec); err != nil {
-				log.Printf("Error checking due loans: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
 			}
 		}
-	}()
+	})
 
 	// Start gRPC server
-	if err := server.Serve(lis); err != nil {
+	if err := service.Serve(server, lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	log.Println("Borrower notification service shut down")
 }
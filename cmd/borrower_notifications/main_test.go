@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+)
+
+func TestCatchUpWindow(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("failed to load Europe/London: %v", err)
+	}
+	day := func(s string) time.Time {
+		d, err := time.ParseInLocation(time.DateOnly, s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	// Open on weekdays; 4 June 2025 is a Wednesday
+	weekdays := calendar.Hours{Opens: 9 * 60, Closes: 17 * 60}
+	cal := &calendar.Calendar{Weekly: map[time.Weekday]calendar.Hours{
+		time.Monday: weekdays, time.Tuesday: weekdays, time.Wednesday: weekdays, time.Thursday: weekdays, time.Friday: weekdays,
+	}}
+	wednesday := time.Date(2025, 6, 4, 12, 0, 0, 0, loc)
+
+	tests := []struct {
+		name           string
+		now            time.Time
+		asOf           time.Time
+		watermark      time.Time
+		maxCatchUpDays int
+		wantFrom       string
+		wantHorizon    string
+		wantLimit      string
+	}{
+		{"periodic after yesterday's check", wednesday, wednesday, day("2025-06-05"), 7, "2025-06-06", "2025-06-06", "2025-06-06"},
+		{"periodic without a watermark", wednesday, wednesday, time.Time{}, 7, "2025-06-06", "2025-06-06", "2025-06-06"},
+		{"periodic after being down", wednesday, wednesday, day("2025-05-20"), 7, "2025-06-04", "2025-06-06", "2025-06-06"},
+		// Only as of checks are limited, and the periodic check never goes back further than today anyway
+		{"periodic ignores catch up limit", wednesday, wednesday, day("2025-05-20"), 1, "2025-06-04", "2025-06-06", "2025-06-06"},
+		{"periodic after a check as of a later date", wednesday, wednesday, day("2025-06-10"), 7, "2025-06-06", "2025-06-06", "2025-06-06"},
+		{
+			"periodic over a weekend",
+			time.Date(2025, 6, 6, 12, 0, 0, 0, loc), time.Date(2025, 6, 6, 12, 0, 0, 0, loc),
+			day("2025-06-05"), 7, "2025-06-06", "2025-06-10", "2025-06-10",
+		},
+		{"as of a later date within the limit", wednesday, day("2025-06-09"), day("2025-06-05"), 7, "2025-06-06", "2025-06-11", "2025-06-06"},
+		{"as of a later date beyond the limit", wednesday, day("2025-06-30"), day("2025-06-05"), 7, "2025-06-25", "2025-07-02", "2025-06-06"},
+		{"as of an earlier date", wednesday, day("2025-06-02"), day("2025-06-03"), 7, "2025-06-04", "2025-06-04", "2025-06-06"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, horizon, limit := catchUpWindow(cal, tt.now, tt.asOf, tt.watermark, tt.maxCatchUpDays)
+			for _, check := range []struct {
+				name      string
+				got, want time.Time
+			}{
+				{"from", from, day(tt.wantFrom)},
+				{"horizon", horizon, day(tt.wantHorizon)},
+				{"watermark limit", limit, day(tt.wantLimit)},
+			} {
+				if !check.got.Equal(check.want) {
+					t.Errorf("%s = %s, want %s", check.name, check.got.Format(time.RFC3339), check.want.Format(time.RFC3339))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gocql/gocql"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/notifications"
+	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
+	borrowernotificationv1 "github.com/mattgallagher92/library-book-tracker/proto/borrower_notification/v1"
+)
+
+// Notification is something that a recipient has been, or will be, told
+type Notification struct {
+	ID            gocql.UUID
+	RecipientID   gocql.UUID
+	RecipientType string
+	Type          string
+	Status        string
+	Channel       Channel
+	// Details describe what the notification is about, e.g. the title of a book that is due soon
+	Details   map[string]string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+const recipientTypeBorrower = "borrower"
+
+// createNotification records a notification with status waiting, unless it already exists (e.g. because it was
+// deferred by an earlier check)
+func createNotification(session *gocql.Session, n Notification) error {
+	existing := map[string]interface{}{}
+	_, err := session.Query(
+		`INSERT INTO notifications (
+			recipient_id, notification_id, recipient_type, type, status, channel, details, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		IF NOT EXISTS`,
+		n.RecipientID, n.ID, n.RecipientType, n.Type, notifications.StatusWaiting, string(n.Channel), n.Details,
+		n.CreatedAt, n.CreatedAt,
+	).MapScanCAS(existing)
+	return err
+}
+
+// markNotificationQueued records that a command to send the notification has been published via the channel
+func markNotificationQueued(session *gocql.Session, n Notification, channel Channel, at time.Time) error {
+	// The condition stops a delayed update from overwriting the sent status
+	existing := map[string]interface{}{}
+	_, err := session.Query(
+		`UPDATE notifications
+		 SET status = ?, channel = ?, updated_at = ?
+		 WHERE recipient_id = ? AND notification_id = ?
+		 IF status = ?`,
+		notifications.StatusQueued, string(channel), at,
+		n.RecipientID, n.ID,
+		notifications.StatusWaiting,
+	).MapScanCAS(existing)
+	return err
+}
+
+// markNotificationSent records that the email or SMS service has confirmed that the notification was delivered
+func markNotificationSent(session *gocql.Session, recipientID, notificationID gocql.UUID, at time.Time) (bool, error) {
+	// Conditional so that it doesn't create a partial row for an unknown notification
+	existing := map[string]interface{}{}
+	return session.Query(
+		`UPDATE notifications
+		 SET status = ?, updated_at = ?
+		 WHERE recipient_id = ? AND notification_id = ?
+		 IF status IN (?, ?)`,
+		notifications.StatusSent, at,
+		recipientID, notificationID,
+		notifications.StatusWaiting, notifications.StatusQueued,
+	).MapScanCAS(existing)
+}
+
+// listNotifications returns the recipient's notifications, most recent first
+func listNotifications(session *gocql.Session, recipientID gocql.UUID) ([]Notification, error) {
+	iter := session.Query(
+		`SELECT notification_id, recipient_type, type, status, channel, details, created_at, updated_at
+		 FROM notifications
+		 WHERE recipient_id = ?`,
+		recipientID,
+	).Idempotent(true).Iter()
+
+	var (
+		result  []Notification
+		n       Notification
+		channel string
+	)
+	for iter.Scan(&n.ID, &n.RecipientType, &n.Type, &n.Status, &channel, &n.Details, &n.CreatedAt, &n.UpdatedAt) {
+		n.RecipientID = recipientID
+		n.Channel = Channel(channel)
+		result = append(result, n)
+		n = Notification{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func notificationToProto(n Notification) *borrowernotificationv1.Notification {
+	return &borrowernotificationv1.Notification{
+		Id:        n.ID.String(),
+		Type:      n.Type,
+		Status:    n.Status,
+		Channel:   preferencesToProto(Preferences{Channel: n.Channel}).Channel,
+		Details:   n.Details,
+		CreatedAt: n.CreatedAt.Format(time.RFC3339),
+		UpdatedAt: n.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// statusHandler applies notification status changed events published by the email and SMS services
+type statusHandler struct {
+	session      *gocql.Session
+	timeProvider timeProvider.Provider
+	codec        *goavro.Codec
+}
+
+func (h *statusHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
+func (h *statusHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
+
+func (h *statusHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		event, err := notifications.DecodeStatusChanged(h.codec, message.Value)
+		if err != nil {
+			log.Printf("Failed to decode status changed event at offset %d: %v", message.Offset, err)
+			session.MarkMessage(message, "")
+			continue
+		}
+
+		if event.Status != notifications.StatusSent {
+			log.Printf("Ignoring unexpected status %q for notification %s", event.Status, event.NotificationID)
+			session.MarkMessage(message, "")
+			continue
+		}
+
+		// Use this service's clock rather than the event's so that timestamps are consistent with simulated time
+		applied, err := markNotificationSent(h.session, event.RecipientID, event.NotificationID, h.timeProvider.Now())
+		if err != nil {
+			// Leave the message unmarked so that it is redelivered
+			log.Printf("Failed to mark notification %s as sent: %v", event.NotificationID, err)
+			return err
+		}
+		if applied {
+			log.Printf("Notification %s to %s has been sent", event.NotificationID, event.RecipientID)
+		} else {
+			log.Printf("Notification %s to %s is unknown or already sent", event.NotificationID, event.RecipientID)
+		}
+
+		session.MarkMessage(message, "")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	borrowernotificationv1 "github.com/mattgallagher92/library-book-tracker/proto/borrower_notification/v1"
+)
+
+// Channel is how a borrower receives notifications
+type Channel string
+
+const (
+	ChannelEmail Channel = "email"
+	ChannelSMS   Channel = "sms"
+	ChannelNone  Channel = "none"
+)
+
+// Notification types that borrowers can opt in to or out of
+const (
+	NotificationTypeDueSoon = "due-soon"
+)
+
+// Preferences controls which notifications a borrower receives and how
+type Preferences struct {
+	Channel Channel
+	// NotificationTypes records whether the borrower has opted in (true) or out (false) of each type;
+	// types not present are opted in
+	NotificationTypes map[string]bool
+	// QuietHours is nil if the borrower has no quiet hours
+	QuietHours *QuietHours
+}
+
+// QuietHours is a daily period during which notifications are held back. Times are minutes after midnight and End
+// may be earlier than Start for a period that spans midnight.
+type QuietHours struct {
+	Start int
+	End   int
+}
+
+func defaultPreferences() Preferences {
+	return Preferences{
+		Channel:           ChannelEmail,
+		NotificationTypes: map[string]bool{},
+	}
+}
+
+// Allows reports whether the borrower wants to receive notifications of the given type at all
+func (p Preferences) Allows(notificationType string) bool {
+	if p.Channel == ChannelNone {
+		return false
+	}
+	optedIn, ok := p.NotificationTypes[notificationType]
+	return !ok || optedIn
+}
+
+// Contains reports whether t falls within the quiet hours, using t's location
+func (q *QuietHours) Contains(t time.Time) bool {
+	if q == nil || q.Start == q.End {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if q.Start < q.End {
+		return minute >= q.Start && minute < q.End
+	}
+	return minute >= q.Start || minute < q.End
+}
+
+func loadPreferences(session *gocql.Session, borrowerID gocql.UUID) (Preferences, error) {
+	var (
+		channel           string
+		notificationTypes map[string]bool
+		quietHoursStart   *int
+		quietHoursEnd     *int
+	)
+	if err := session.Query(
+		`SELECT channel, notification_types, quiet_hours_start, quiet_hours_end
+		 FROM notification_preferences
+		 WHERE borrower_id = ?`,
+		borrowerID,
+	).Idempotent(true).Scan(&channel, &notificationTypes, &quietHoursStart, &quietHoursEnd); err != nil {
+		if err == gocql.ErrNotFound {
+			return defaultPreferences(), nil
+		}
+		return Preferences{}, err
+	}
+
+	prefs := defaultPreferences()
+	if channel != "" {
+		prefs.Channel = Channel(channel)
+	}
+	if notificationTypes != nil {
+		prefs.NotificationTypes = notificationTypes
+	}
+	if quietHoursStart != nil && quietHoursEnd != nil {
+		prefs.QuietHours = &QuietHours{Start: *quietHoursStart, End: *quietHoursEnd}
+	}
+	return prefs, nil
+}
+
+func savePreferences(session *gocql.Session, borrowerID gocql.UUID, prefs Preferences) error {
+	var quietHoursStart, quietHoursEnd *int
+	if prefs.QuietHours != nil {
+		quietHoursStart = &prefs.QuietHours.Start
+		quietHoursEnd = &prefs.QuietHours.End
+	}
+	return session.Query(
+		`INSERT INTO notification_preferences (
+			borrower_id, channel, notification_types, quiet_hours_start, quiet_hours_end
+		) VALUES (?, ?, ?, ?, ?)`,
+		borrowerID, string(prefs.Channel), prefs.NotificationTypes, quietHoursStart, quietHoursEnd,
+	).Idempotent(true).Exec()
+}
+
+func preferencesToProto(prefs Preferences) *borrowernotificationv1.NotificationPreferences {
+	pb := &borrowernotificationv1.NotificationPreferences{
+		NotificationTypes: prefs.NotificationTypes,
+	}
+	switch prefs.Channel {
+	case ChannelSMS:
+		pb.Channel = borrowernotificationv1.Channel_CHANNEL_SMS
+	case ChannelNone:
+		pb.Channel = borrowernotificationv1.Channel_CHANNEL_NONE
+	default:
+		pb.Channel = borrowernotificationv1.Channel_CHANNEL_EMAIL
+	}
+	if prefs.QuietHours != nil {
+		pb.QuietHours = &borrowernotificationv1.QuietHours{
+			Start: formatMinutes(prefs.QuietHours.Start),
+			End:   formatMinutes(prefs.QuietHours.End),
+		}
+	}
+	return pb
+}
+
+func preferencesFromProto(pb *borrowernotificationv1.NotificationPreferences) (Preferences, error) {
+	prefs := defaultPreferences()
+	if pb == nil {
+		return prefs, nil
+	}
+
+	switch pb.Channel {
+	case borrowernotificationv1.Channel_CHANNEL_UNSPECIFIED, borrowernotificationv1.Channel_CHANNEL_EMAIL:
+		prefs.Channel = ChannelEmail
+	case borrowernotificationv1.Channel_CHANNEL_SMS:
+		prefs.Channel = ChannelSMS
+	case borrowernotificationv1.Channel_CHANNEL_NONE:
+		prefs.Channel = ChannelNone
+	default:
+		return Preferences{}, fmt.Errorf("unknown channel %v", pb.Channel)
+	}
+
+	for notificationType, optedIn := range pb.NotificationTypes {
+		prefs.NotificationTypes[notificationType] = optedIn
+	}
+
+	if pb.QuietHours != nil {
+		start, err := parseMinutes(pb.QuietHours.Start)
+		if err != nil {
+			return Preferences{}, fmt.Errorf("invalid quiet hours start: %w", err)
+		}
+		end, err := parseMinutes(pb.QuietHours.End)
+		if err != nil {
+			return Preferences{}, fmt.Errorf("invalid quiet hours end: %w", err)
+		}
+		prefs.QuietHours = &QuietHours{Start: start, End: end}
+	}
+
+	return prefs, nil
+}
+
+// parseMinutes converts a 24-hour "HH:MM" time to minutes after midnight
+func parseMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatMinutes(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
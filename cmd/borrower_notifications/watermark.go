@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// dueSoonWatermark names the watermark recording the last due day that every loan has been notified for
+const dueSoonWatermark = "due-soon"
+
+// loadWatermark returns the last day processed by the named sweep, as midnight in loc, or the zero time if the sweep
+// has never completed a day
+func loadWatermark(session *gocql.Session, name string, loc *time.Location) (time.Time, error) {
+	var day time.Time
+	if err := session.Query(
+		`SELECT last_processed_day FROM sweep_watermarks WHERE name = ?`,
+		name,
+	).Idempotent(true).Scan(&day); err != nil {
+		if err == gocql.ErrNotFound {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc), nil
+}
+
+func saveWatermark(session *gocql.Session, name string, day time.Time) error {
+	return session.Query(
+		`UPDATE sweep_watermarks SET last_processed_day = ? WHERE name = ?`,
+		day.Format(time.DateOnly), name,
+	).Idempotent(true).Exec()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/deadletter"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+)
+
+// Replays messages from a dead letter topic onto the topic they originally came from.
+// Progress is tracked with committed offsets, so each dead-lettered message is only replayed once.
+func main() {
+	topic := flag.String("topic", "", "Dead letter topic to replay, e.g. send-email-command.dlq")
+	dryRun := flag.Bool("dry-run", false, "Log the messages that would be replayed without publishing them")
+	flag.Parse()
+
+	if *topic == "" {
+		log.Fatalf("The -topic flag is required")
+	}
+
+	log.Printf("Dead letter replay of %s starting...", *topic)
+
+	cfg, err := config.LoadDLQReplayConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	replayed, err := replay(cfg, *topic, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to replay %s after replaying %d message(s): %v", *topic, replayed, err)
+	}
+
+	log.Printf("Replayed %d message(s) from %s", replayed, *topic)
+}
+
+// replay replays every partition of topic. It returns errors rather than exiting so that the Kafka clients are always
+// closed.
+func replay(cfg *config.DLQReplayConfig, topic string, dryRun bool) (int, error) {
+	kafkaConfig, err := kafka.ProducerConfig(cfg.KafkaConfig)
+	if err != nil {
+		return 0, fmt.Errorf("failed to configure Kafka: %w", err)
+	}
+	kafkaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	// Offsets are committed after each message is replayed instead, so that a failure part way through doesn't lose
+	// track of the messages already replayed
+	kafkaConfig.Consumer.Offsets.AutoCommit.Enable = false
+	kafkaConfig.Consumer.Return.Errors = true
+
+	client, err := sarama.NewClient(cfg.KafkaBrokers, kafkaConfig)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	defer client.Close()
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+	defer producer.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Kafka consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	offsetManager, err := sarama.NewOffsetManagerFromClient("dlq-replay", client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create offset manager: %w", err)
+	}
+	defer offsetManager.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get partitions: %w", err)
+	}
+
+	replayed := 0
+	for _, partition := range partitions {
+		n, err := replayPartition(client, consumer, offsetManager, producer, topic, partition, dryRun)
+		replayed += n
+		if err != nil {
+			return replayed, fmt.Errorf("partition %d: %w", partition, err)
+		}
+	}
+	return replayed, nil
+}
+
+// replayPartition replays every message in the partition from the committed offset up to the newest message at the
+// time it was called
+func replayPartition(
+	client sarama.Client,
+	consumer sarama.Consumer,
+	offsetManager sarama.OffsetManager,
+	producer sarama.SyncProducer,
+	topic string,
+	partition int32,
+	dryRun bool,
+) (int, error) {
+	partitionOffsets, err := offsetManager.ManagePartition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer partitionOffsets.Close()
+
+	next, _ := partitionOffsets.NextOffset()
+	end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	if next == sarama.OffsetOldest {
+		if next, err = client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+			return 0, err
+		}
+	}
+	if next >= end {
+		log.Printf("Nothing to replay in partition %d", partition)
+		return 0, nil
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, next)
+	if err != nil {
+		return 0, err
+	}
+	defer partitionConsumer.Close()
+
+	replayed := 0
+	for {
+		var message *sarama.ConsumerMessage
+		select {
+		case message = <-partitionConsumer.Messages():
+		case err := <-partitionConsumer.Errors():
+			return replayed, err
+		}
+
+		log.Printf("Replaying message at offset %d of partition %d (attempts: %s, error: %s)",
+			message.Offset, partition,
+			deadletter.HeaderValue(message, deadletter.HeaderAttempts),
+			deadletter.HeaderValue(message, deadletter.HeaderError))
+
+		if !dryRun {
+			if _, _, err := producer.SendMessage(deadletter.NewReplayMessage(message)); err != nil {
+				return replayed, err
+			}
+			if err := commit(offsetManager, partitionOffsets, message.Offset+1); err != nil {
+				return replayed, fmt.Errorf("replayed message at offset %d but failed to commit: %w", message.Offset, err)
+			}
+		}
+		replayed++
+
+		if message.Offset+1 >= end {
+			return replayed, nil
+		}
+	}
+}
+
+// commit commits offset as the next message to replay from the partition, so that a later run doesn't replay the
+// messages before it again
+func commit(offsetManager sarama.OffsetManager, partitionOffsets sarama.PartitionOffsetManager, offset int64) error {
+	partitionOffsets.MarkOffset(offset, "")
+	offsetManager.Commit()
+	// Commit reports failures on the partition's error channel rather than returning them
+	select {
+	case err := <-partitionOffsets.Errors():
+		return err
+	default:
+		return nil
+	}
+}
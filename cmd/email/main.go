@@ -2,42 +2,98 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/IBM/sarama"
-	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
 	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/delivery"
+	"github.com/mattgallagher92/library-book-tracker/internal/email"
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+	"github.com/mattgallagher92/library-book-tracker/internal/notifications"
 )
 
 func main() {
 	log.Println("Email service starting...")
 
-	// Load and parse Avro schema
-	schemaFile, err := os.ReadFile("schemas/avro/commands/send_email.avsc")
+	// Load and parse Avro schemas
+	codec, err := email.LoadCommandCodec()
 	if err != nil {
-		log.Fatalf("Failed to read Avro schema: %v", err)
+		log.Fatalf("Failed to load send email command Avro schemas: %v", err)
 	}
-	codec, err := goavro.NewCodec(string(schemaFile))
+
+	statusCodec, err := notifications.LoadStatusCodec("schemas/avro/events/notification_status_changed.avsc")
 	if err != nil {
-		log.Fatalf("Failed to parse Avro schema: %v", err)
+		log.Fatalf("Failed to load notification status Avro schema: %v", err)
 	}
 
-	// Configure Kafka consumer
-	saramaConfig := sarama.NewConfig()
-	saramaConfig.Consumer.Group.Rebalance.Strategy = sarama.NewBalanceStrategyRoundRobin()
-	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
-
 	// Load email-specific configuration
 	cfg, err := config.LoadEmailConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Load message catalogs and email templates
+	catalogs, err := i18n.LoadCatalogs(cfg.LocalesDir)
+	if err != nil {
+		log.Fatalf("Failed to load message catalogs: %v", err)
+	}
+	for _, locale := range catalogs.Locales() {
+		if missing := catalogs.MissingKeys(locale); len(missing) > 0 {
+			log.Printf("Message catalog for %s is missing %d key(s), which will fall back to %s: %v",
+				locale, len(missing), i18n.DefaultLocale, missing)
+		}
+	}
+
+	templates, err := email.LoadTemplates(cfg.TemplatesDir, catalogs)
+	if err != nil {
+		log.Fatalf("Failed to load email templates: %v", err)
+	}
+
+	// Create Cassandra session
+	cassandraSession, err := cassandra.NewSession(cfg.CassandraConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Cassandra session: %v", err)
+	}
+	defer cassandraSession.Close()
+
+	log.Println("Connected to Cassandra")
+
+	// Initialize email sender
+	var sender email.Sender
+	switch cfg.Sender {
+	case "smtp":
+		log.Printf("Sending emails via SMTP server %s:%d", cfg.SMTPHost, cfg.SMTPPort)
+		sender = &email.SMTPSender{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			From:     cfg.FromAddress,
+			StartTLS: cfg.SMTPStartTLS,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		}
+	default:
+		log.Printf("Capturing emails in maildir %s", cfg.CaptureDir)
+		sender = &email.MaildirSender{
+			Dir:  cfg.CaptureDir,
+			From: cfg.FromAddress,
+		}
+	}
+
+	// Configure Kafka producer for notification status events and dead-lettering commands that can't be processed
+	producer, err := kafka.NewSyncProducer(cfg.KafkaConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Kafka producer: %v", err)
+	}
+	defer producer.Close()
+
 	// Create consumer group
-	group, err := sarama.NewConsumerGroup(cfg.KafkaBrokers, "email-service", saramaConfig)
+	group, err := kafka.NewConsumerGroup(cfg.KafkaConfig, "email-service", sarama.OffsetNewest)
 	if err != nil {
 		log.Fatalf("Failed to create consumer group: %v", err)
 	}
@@ -53,57 +109,64 @@ func main() {
 		cancel()
 	}()
 
-	// Create consumer handler
-	handler := &ConsumerGroupHandler{
-		codec: codec,
-	}
-
 	// Consume messages
-	for {
-		err := group.Consume(ctx, []string{"send-email-command"}, handler)
-		if err != nil {
-			if ctx.Err() != nil {
-				// Context was cancelled, time to exit
-				break
-			}
-			log.Printf("Error from consumer: %v", err)
-		}
+	handler := &delivery.Handler[email.Message]{
+		Name:        "email",
+		ToField:     "toAddress",
+		Decode:      codec.Decode,
+		Channel:     &emailChannel{templates: templates, sender: sender},
+		SentStore:   &email.CassandraSentStore{Session: cassandraSession},
+		StatusCodec: statusCodec,
+		Producer:    producer,
+		Retry:       cfg.RetryConfig,
 	}
+	handler.Consume(ctx, group, email.CommandTopic)
 
 	log.Println("Email service shutting down...")
 }
 
-// ConsumerGroupHandler implements sarama.ConsumerGroupHandler
-type ConsumerGroupHandler struct {
-	codec *goavro.Codec
+// emailChannel renders emails from templates and sends them with the configured sender
+type emailChannel struct {
+	templates *email.Templates
+	sender    email.Sender
 }
 
-func (h *ConsumerGroupHandler) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
-func (h *ConsumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
-
-func (h *ConsumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		// Deserialize Avro message
-		native, _, err := h.codec.NativeFromBinary(message.Value)
-		if err != nil {
-			log.Printf("Failed to deserialize message: %v", err)
-			continue
+func (c *emailChannel) Render(req delivery.Request) (email.Message, error) {
+	if req.TemplateID == "" {
+		// Commands published before emails were templated give the subject and plain text body instead
+		subject, hasSubject := optionalString(req.Record["subject"])
+		body, hasBody := optionalString(req.Record["body"])
+		if !hasSubject || !hasBody {
+			return email.Message{}, fmt.Errorf("command has neither a template nor a subject and body")
 		}
+		return email.Message{To: req.To, Subject: subject, TextBody: body}, nil
+	}
 
-		record, ok := native.(map[string]interface{})
-		if !ok {
-			log.Printf("Unexpected message format")
-			continue
-		}
+	msg, err := c.templates.Render(req.TemplateID, req.Locale, req.To, req.Parameters, req.Items)
+	if err != nil {
+		return email.Message{}, fmt.Errorf("failed to render template %q: %w", req.TemplateID, err)
+	}
+	return msg, nil
+}
 
-		// Log the email details
-		log.Printf("sending email...\nTo: %v\nSubject: %v\nBody: %v",
-			record["toAddress"],
-			record["subject"],
-			record["body"])
+func (c *emailChannel) Send(ctx context.Context, msg email.Message) error {
+	return c.sender.Send(ctx, msg)
+}
+
+func (c *emailChannel) IsPermanent(err error) bool {
+	return email.IsPermanent(err)
+}
 
-		// Mark message as processed
-		session.MarkMessage(message, "")
+// optionalString reads a string field that is either a plain string, in legacy commands, or an Avro union of null and
+// string
+func optionalString(native interface{}) (string, bool) {
+	switch v := native.(type) {
+	case string:
+		return v, true
+	case map[string]interface{}:
+		s, ok := v["string"].(string)
+		return s, ok
+	default:
+		return "", false
 	}
-	return nil
 }
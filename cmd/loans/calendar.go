@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+	loansv1 "github.com/mattgallagher92/library-book-tracker/proto/loans/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *loansServer) GetCalendar(ctx context.Context, req *loansv1.GetCalendarRequest) (*loansv1.GetCalendarResponse, error) {
+	cal, err := calendar.Load(s.session)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load calendar: %v", err)
+	}
+
+	resp := &loansv1.GetCalendarResponse{}
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if hours, ok := cal.Weekly[weekday]; ok {
+			resp.OpeningHours = append(resp.OpeningHours, &loansv1.WeekdayOpeningHours{
+				Weekday: weekday.String(),
+				Hours:   hoursToProto(hours),
+			})
+		}
+	}
+
+	for _, exception := range cal.Exceptions {
+		pb := &loansv1.CalendarException{
+			Date:        exception.Date,
+			Description: exception.Description,
+		}
+		if exception.Hours != nil {
+			pb.Hours = hoursToProto(*exception.Hours)
+		}
+		resp.Exceptions = append(resp.Exceptions, pb)
+	}
+	sort.Slice(resp.Exceptions, func(i, j int) bool {
+		return resp.Exceptions[i].Date < resp.Exceptions[j].Date
+	})
+
+	return resp, nil
+}
+
+func (s *loansServer) UpdateOpeningHours(ctx context.Context, req *loansv1.UpdateOpeningHoursRequest) (*loansv1.UpdateOpeningHoursResponse, error) {
+	weekly := map[time.Weekday]calendar.Hours{}
+	for _, day := range req.OpeningHours {
+		weekday, err := parseWeekday(day.Weekday)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid opening hours: %v", err)
+		}
+		if _, ok := weekly[weekday]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "opening hours given more than once for %s", weekday)
+		}
+		hours, err := hoursFromProto(day.Hours)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid opening hours for %s: %v", weekday, err)
+		}
+		weekly[weekday] = hours
+	}
+
+	if err := calendar.SaveWeekly(s.session, weekly); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save opening hours: %v", err)
+	}
+	return &loansv1.UpdateOpeningHoursResponse{}, nil
+}
+
+func (s *loansServer) SetCalendarException(ctx context.Context, req *loansv1.SetCalendarExceptionRequest) (*loansv1.SetCalendarExceptionResponse, error) {
+	if req.Exception == nil {
+		return nil, status.Error(codes.InvalidArgument, "exception is required")
+	}
+	if _, err := time.Parse(time.DateOnly, req.Exception.Date); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid date: %v", err)
+	}
+
+	exception := calendar.Exception{
+		Date:        req.Exception.Date,
+		Description: req.Exception.Description,
+	}
+	if req.Exception.Hours != nil {
+		hours, err := hoursFromProto(req.Exception.Hours)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid opening hours: %v", err)
+		}
+		exception.Hours = &hours
+	}
+
+	if err := calendar.SaveException(s.session, exception); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save calendar exception: %v", err)
+	}
+	return &loansv1.SetCalendarExceptionResponse{}, nil
+}
+
+func (s *loansServer) RemoveCalendarException(ctx context.Context, req *loansv1.RemoveCalendarExceptionRequest) (*loansv1.RemoveCalendarExceptionResponse, error) {
+	if _, err := time.Parse(time.DateOnly, req.Date); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid date: %v", err)
+	}
+
+	if err := calendar.RemoveException(s.session, req.Date); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove calendar exception: %v", err)
+	}
+	return &loansv1.RemoveCalendarExceptionResponse{}, nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if weekday.String() == s {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+func hoursToProto(hours calendar.Hours) *loansv1.OpeningHours {
+	return &loansv1.OpeningHours{
+		Opens:  formatMinutes(hours.Opens),
+		Closes: formatMinutes(hours.Closes),
+	}
+}
+
+func hoursFromProto(pb *loansv1.OpeningHours) (calendar.Hours, error) {
+	if pb == nil {
+		return calendar.Hours{}, fmt.Errorf("hours are required")
+	}
+	opens, err := parseMinutes(pb.Opens)
+	if err != nil {
+		return calendar.Hours{}, fmt.Errorf("invalid opening time: %w", err)
+	}
+	closes, err := parseMinutes(pb.Closes)
+	if err != nil {
+		return calendar.Hours{}, fmt.Errorf("invalid closing time: %w", err)
+	}
+	if closes <= opens {
+		return calendar.Hours{}, fmt.Errorf("closing time must be after opening time")
+	}
+	return calendar.Hours{Opens: opens, Closes: closes}, nil
+}
+
+// parseMinutes converts a 24-hour "HH:MM" time to minutes after midnight
+func parseMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatMinutes(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
@@ -3,15 +3,20 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
-	"os"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
 	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/lifecycle"
+	"github.com/mattgallagher92/library-book-tracker/internal/simclock"
 	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
 	loansv1 "github.com/mattgallagher92/library-book-tracker/proto/loans/v1"
+	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
@@ -24,18 +29,27 @@ type BorrowBookCommand struct {
 	BookID     gocql.UUID
 }
 
+// loanDuration is the number of days that a book is lent for
+const loanDuration = 7
+
 // ErrTooManyBooksCheckedOut indicates the borrower has reached their limit
 var ErrTooManyBooksCheckedOut = errors.New("borrower has reached maximum number of checked out books")
 
-func handleBorrowBook(session *gocql.Session, provider timeProvider.Provider, cmd BorrowBookCommand) (time.Time, error) {
+func handleBorrowBook(session *gocql.Session, provider timeProvider.Provider, location *time.Location, cmd BorrowBookCommand) (time.Time, error) {
 	log.Printf("Starting borrow book process for borrower %s and book %s", cmd.BorrowerID, cmd.BookID)
 
+	// Load the calendar before changing anything, as the due date depends on it
+	cal, err := calendar.Load(session)
+	if err != nil {
+		return time.Time{}, err
+	}
+
 	// First check if borrower can take out more books
 	var checkedOutBooks int
 	if err := session.Query(
 		`SELECT checked_out_books FROM borrower_book_count WHERE id = ?`,
 		cmd.BorrowerID,
-	).Scan(&checkedOutBooks); err != nil {
+	).Idempotent(true).Scan(&checkedOutBooks); err != nil {
 		if err == gocql.ErrNotFound {
 			checkedOutBooks = 0
 		} else {
@@ -49,7 +63,7 @@ func handleBorrowBook(session *gocql.Session, provider timeProvider.Provider, cm
 		return time.Time{}, ErrTooManyBooksCheckedOut
 	}
 
-	// Increment checked out books counter
+	// Increment checked out books counter. Counter updates aren't idempotent, so this isn't retried.
 	if err := session.Query(
 		`UPDATE borrower_book_count SET checked_out_books = checked_out_books + 1 WHERE id = ?`,
 		cmd.BorrowerID,
@@ -73,11 +87,11 @@ func handleBorrowBook(session *gocql.Session, provider timeProvider.Provider, cm
 	log.Printf("Added book location update to batch for %s to checked out with %s", cmd.BookID, cmd.BorrowerID)
 
 	// Get borrower info
-	var borrowerName, borrowerEmail string
+	var borrowerName, borrowerEmail, borrowerLanguage string
 	if err := session.Query(
-		`SELECT name, email_address FROM borrower WHERE id = ?`,
+		`SELECT name, email_address, preferred_language FROM borrower WHERE id = ?`,
 		cmd.BorrowerID,
-	).Scan(&borrowerName, &borrowerEmail); err != nil {
+	).Idempotent(true).Scan(&borrowerName, &borrowerEmail, &borrowerLanguage); err != nil {
 		return time.Time{}, err
 	}
 	log.Printf("Retrieved borrower details for %s", cmd.BorrowerID)
@@ -87,30 +101,39 @@ func handleBorrowBook(session *gocql.Session, provider timeProvider.Provider, cm
 	if err := session.Query(
 		`SELECT title, author_first_name, author_surname FROM book_locations WHERE book_id = ?`,
 		cmd.BookID,
-	).Scan(&bookTitle, &authorFirstName, &authorSurname); err != nil {
+	).Idempotent(true).Scan(&bookTitle, &authorFirstName, &authorSurname); err != nil {
 		return time.Time{}, err
 	}
 	log.Printf("Retrieved book details for %s", cmd.BookID)
 
 	// Create loan record
-	now := provider.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	dueDate := today.AddDate(0, 0, 7) // 1 week loan duration
+	// Loans are due at the start of a day in the library's time zone, whatever time zone the time is given in
+	dueDate := cal.DueDate(provider.Now(), location, loanDuration)
 	batch.Query(
 		`INSERT INTO loans (
 			borrower_id, due_date, book_id,
-			borrower_name, borrower_email,
+			borrower_name, borrower_email, borrower_language,
 			book_title, book_author, due_soon_notification_sent
-		) VALUES (?, ?, ?, ?, ?, ?, ?, false)`,
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, false)`,
 		cmd.BorrowerID, dueDate, cmd.BookID,
-		borrowerName, borrowerEmail,
+		borrowerName, borrowerEmail, borrowerLanguage,
+		bookTitle, authorFirstName+" "+authorSurname,
+	)
+	batch.Query(
+		`INSERT INTO loans_by_due_day (
+			due_day, borrower_id, book_id, due_date,
+			borrower_name, borrower_email, borrower_language,
+			book_title, book_author, due_soon_notification_sent
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, false)`,
+		dueDate.Format(time.DateOnly), cmd.BorrowerID, cmd.BookID, dueDate,
+		borrowerName, borrowerEmail, borrowerLanguage,
 		bookTitle, authorFirstName+" "+authorSurname,
 	)
 	log.Printf("Added loan record creation to batch for book %s and borrower %s with due date %s",
 		cmd.BookID, cmd.BorrowerID, dueDate.Format(time.RFC3339))
 
 	// Execute all updates atomically
-	if err := session.ExecuteBatch(batch); err != nil {
+	if err := session.ExecuteBatch(cassandra.MarkIdempotent(batch)); err != nil {
 		// TODO: in this case the earlier counter increment should be reverted.
 		log.Printf("Failed to execute batch for book %s and borrower %s: %v", cmd.BookID, cmd.BorrowerID, err)
 		return time.Time{}, err
@@ -125,21 +148,10 @@ type loansServer struct {
 	loansv1.UnimplementedLoansServiceServer
 	session      *gocql.Session
 	timeProvider timeProvider.Provider
+	location     *time.Location
 }
 
 // BorrowBook implements the gRPC method for borrowing a book
-func (s *loansServer) UpdateSimulatedTime(ctx context.Context, req *loansv1.UpdateSimulatedTimeRequest) (*loansv1.UpdateSimulatedTimeResponse, error) {
-	if provider, ok := s.timeProvider.(*timeProvider.SimulatedProvider); ok {
-		t, err := time.Parse(time.RFC3339, req.Timestamp)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid timestamp format: %v", err)
-		}
-		provider.SetTime(t)
-		return &loansv1.UpdateSimulatedTimeResponse{}, nil
-	}
-	return nil, status.Error(codes.FailedPrecondition, "time simulation not enabled")
-}
-
 func (s *loansServer) BorrowBook(ctx context.Context, req *loansv1.BorrowBookRequest) (*loansv1.BorrowBookResponse, error) {
 	borrowerID, err := gocql.ParseUUID(req.BorrowerId)
 	if err != nil {
@@ -156,7 +168,7 @@ func (s *loansServer) BorrowBook(ctx context.Context, req *loansv1.BorrowBookReq
 		BookID:     bookID,
 	}
 
-	dueDate, err := handleBorrowBook(s.session, s.timeProvider, cmd)
+	dueDate, err := handleBorrowBook(s.session, s.timeProvider, s.location, cmd)
 	if err != nil {
 		if err == ErrTooManyBooksCheckedOut {
 			return nil, status.Error(codes.FailedPrecondition, err.Error())
@@ -178,25 +190,28 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize Cassandra cluster config
-	cluster := gocql.NewCluster(cfg.CassandraHosts...)
-	cluster.Keyspace = cfg.Keyspace
-	cluster.Consistency = gocql.Quorum
+	// Shut down cleanly on SIGTERM, so that in-flight requests aren't cut off when a pod is replaced
+	service := lifecycle.New(cfg.ShutdownTimeout)
 
-	// Create session
-	session, err := cluster.CreateSession()
+	// Create Cassandra session
+	session, err := cassandra.NewSession(cfg.CassandraConfig)
 	if err != nil {
 		log.Fatalf("Failed to create Cassandra session: %v", err)
 	}
-	defer session.Close()
+	service.OnClose("Cassandra session", func() error {
+		session.Close()
+		return nil
+	})
 
 	log.Println("Connected to Cassandra")
 
 	// Initialize time provider
 	var tp timeProvider.Provider
-	if os.Getenv("SIMULATE_TIME") == "true" {
+	if cfg.SimulateTime {
 		log.Println("Using simulated time")
-		tp = timeProvider.NewSimulatedProvider(time.Now())
+		simulated := timeProvider.NewSimulatedProvider(time.Now())
+		timeProvider.Receive(service.Context(), cfg.SimulatedTimeConfig, timev1.ClientKind_CLIENT_KIND_LOANS, simulated)
+		tp = simulated
 	} else {
 		log.Println("Using actual system time")
 		tp = &timeProvider.RealProvider{}
@@ -207,22 +222,25 @@ func main() {
 	loansv1.RegisterLoansServiceServer(server, &loansServer{
 		session:      session,
 		timeProvider: tp,
+		location:     cfg.TimeZone,
 	})
+	simclock.Register(server, tp)
 
 	// Start listening for gRPC requests
-	lis, err := net.Listen("tcp", ":50051")
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	// Enable reflection in development mode
-	if os.Getenv("ENV") != "production" {
+	if cfg.Env != config.EnvProduction {
 		reflection.Register(server)
 		log.Println("gRPC reflection enabled for development")
 	}
 
-	log.Printf("Server listening on :50051")
-	if err := server.Serve(lis); err != nil {
+	log.Printf("Server listening on :%d", cfg.Port)
+	if err := service.Serve(server, lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	log.Println("Loans service shut down")
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
+	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
+	loansv1 "github.com/mattgallagher92/library-book-tracker/proto/loans/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrLoanNotFound indicates the borrower doesn't have the book on loan
+var ErrLoanNotFound = errors.New("borrower doesn't have the book on loan")
+
+// renewalDueDate returns the date that a loan currently due on current is due once renewed at now, which is a full
+// loan period from the start of now's day in location, rolled forward past closed days like a new loan's. A renewal
+// never brings a due date forward, so it also returns whether the due date changes.
+func renewalDueDate(cal *calendar.Calendar, now time.Time, location *time.Location, current time.Time) (time.Time, bool) {
+	dueDate := cal.DueDate(now, location, loanDuration)
+	if !dueDate.After(current) {
+		return current, false
+	}
+	return dueDate, true
+}
+
+func handleRenewLoan(session *gocql.Session, provider timeProvider.Provider, location *time.Location, borrowerID, bookID gocql.UUID) (time.Time, error) {
+	log.Printf("Starting renewal of book %s for borrower %s", bookID, borrowerID)
+
+	cal, err := calendar.Load(session)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// A borrower has few loans, so their partition is read rather than filtering by book
+	var (
+		dueDate, currentDueDate, returnedDate                        time.Time
+		loanBookID                                                   gocql.UUID
+		borrowerName, borrowerEmail, borrowerLanguage, title, author string
+		found                                                        bool
+	)
+	iter := session.Query(
+		`SELECT due_date, book_id, borrower_name, borrower_email, borrower_language, book_title, book_author, returned_date
+		 FROM loans
+		 WHERE borrower_id = ?`,
+		borrowerID,
+	).Idempotent(true).Iter()
+	for iter.Scan(&dueDate, &loanBookID, &borrowerName, &borrowerEmail, &borrowerLanguage, &title, &author, &returnedDate) {
+		if loanBookID == bookID && returnedDate.IsZero() {
+			currentDueDate = dueDate.In(location)
+			found = true
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		return time.Time{}, ErrLoanNotFound
+	}
+
+	newDueDate, changed := renewalDueDate(cal, provider.Now(), location, currentDueDate)
+	if !changed {
+		log.Printf("Book %s for borrower %s is already due on %s, so renewing doesn't change it",
+			bookID, borrowerID, newDueDate.Format(time.DateOnly))
+		return newDueDate, nil
+	}
+
+	// The due date is part of the key, so the loan is moved to a new row. The due soon flag is reset so that the
+	// borrower is reminded again before the new due date.
+	batch := session.NewBatch(gocql.LoggedBatch)
+	batch.Query(
+		`DELETE FROM loans WHERE borrower_id = ? AND due_date = ? AND book_id = ?`,
+		borrowerID, currentDueDate, bookID,
+	)
+	batch.Query(
+		`INSERT INTO loans (
+			borrower_id, due_date, book_id,
+			borrower_name, borrower_email, borrower_language,
+			book_title, book_author, due_soon_notification_sent
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, false)`,
+		borrowerID, newDueDate, bookID,
+		borrowerName, borrowerEmail, borrowerLanguage,
+		title, author,
+	)
+	batch.Query(
+		`DELETE FROM loans_by_due_day WHERE due_day = ? AND borrower_id = ? AND book_id = ?`,
+		currentDueDate.Format(time.DateOnly), borrowerID, bookID,
+	)
+	batch.Query(
+		`INSERT INTO loans_by_due_day (
+			due_day, borrower_id, book_id, due_date,
+			borrower_name, borrower_email, borrower_language,
+			book_title, book_author, due_soon_notification_sent
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, false)`,
+		newDueDate.Format(time.DateOnly), borrowerID, bookID, newDueDate,
+		borrowerName, borrowerEmail, borrowerLanguage,
+		title, author,
+	)
+	if err := session.ExecuteBatch(cassandra.MarkIdempotent(batch)); err != nil {
+		log.Printf("Failed to renew book %s for borrower %s: %v", bookID, borrowerID, err)
+		return time.Time{}, err
+	}
+	log.Printf("Renewed book %s for borrower %s, now due on %s", bookID, borrowerID, newDueDate.Format(time.DateOnly))
+
+	return newDueDate, nil
+}
+
+// RenewLoan implements the gRPC method for renewing a loan
+func (s *loansServer) RenewLoan(ctx context.Context, req *loansv1.RenewLoanRequest) (*loansv1.RenewLoanResponse, error) {
+	borrowerID, err := gocql.ParseUUID(req.BorrowerId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid borrower ID: %v", err)
+	}
+
+	bookID, err := gocql.ParseUUID(req.BookId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid book ID: %v", err)
+	}
+
+	dueDate, err := handleRenewLoan(s.session, s.timeProvider, s.location, borrowerID, bookID)
+	if err != nil {
+		if err == ErrLoanNotFound {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to renew loan: %v", err)
+	}
+
+	return &loansv1.RenewLoanResponse{
+		DueDate: dueDate.Format(time.RFC3339),
+	}, nil
+}
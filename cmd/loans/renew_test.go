@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/calendar"
+)
+
+func TestRenewalDueDate(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("failed to load Europe/London: %v", err)
+	}
+	day := func(s string) time.Time {
+		d, err := time.ParseInLocation(time.DateOnly, s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	// Open on weekdays, other than on Monday 2 June
+	weekdays := calendar.Hours{Opens: 9 * 60, Closes: 17 * 60}
+	cal := &calendar.Calendar{
+		Weekly: map[time.Weekday]calendar.Hours{
+			time.Monday: weekdays, time.Tuesday: weekdays, time.Wednesday: weekdays, time.Thursday: weekdays, time.Friday: weekdays,
+		},
+		Exceptions: map[string]calendar.Exception{
+			"2025-06-02": {Date: "2025-06-02", Description: "Closed"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		current     time.Time
+		want        time.Time
+		wantChanged bool
+	}{
+		{"renewed on a weekday", time.Date(2025, 5, 20, 15, 0, 0, 0, loc), day("2025-05-22"), day("2025-05-27"), true},
+		// Seven days after Saturday 24 May is Saturday 31 May, and the library is closed until Tuesday
+		{"due on a closed day", time.Date(2025, 5, 24, 11, 0, 0, 0, loc), day("2025-05-27"), day("2025-06-03"), true},
+		{"overdue", time.Date(2025, 5, 30, 9, 30, 0, 0, loc), day("2025-05-22"), day("2025-06-06"), true},
+		{"renewed again on the same day", time.Date(2025, 5, 24, 16, 0, 0, 0, loc), day("2025-06-03"), day("2025-06-03"), false},
+		// A renewal is a full loan period from today, which is sooner than the current due date
+		{"already due later", time.Date(2025, 5, 20, 15, 0, 0, 0, loc), day("2025-06-03"), day("2025-06-03"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := renewalDueDate(cal, tt.now, loc, tt.current)
+			if !got.Equal(tt.want) || changed != tt.wantChanged {
+				t.Errorf("renewalDueDate(%s, %s) = %s, %t; want %s, %t",
+					tt.now.Format(time.RFC3339), tt.current.Format(time.DateOnly),
+					got.Format(time.RFC3339), changed, tt.want.Format(time.RFC3339), tt.wantChanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/delivery"
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+	"github.com/mattgallagher92/library-book-tracker/internal/notifications"
+	"github.com/mattgallagher92/library-book-tracker/internal/sms"
+)
+
+func main() {
+	log.Println("SMS service starting...")
+
+	// Load and parse Avro schema
+	schemaFile, err := os.ReadFile("schemas/avro/commands/send_sms.avsc")
+	if err != nil {
+		log.Fatalf("Failed to read Avro schema: %v", err)
+	}
+	codec, err := goavro.NewCodec(string(schemaFile))
+	if err != nil {
+		log.Fatalf("Failed to parse Avro schema: %v", err)
+	}
+
+	statusCodec, err := notifications.LoadStatusCodec("schemas/avro/events/notification_status_changed.avsc")
+	if err != nil {
+		log.Fatalf("Failed to load notification status Avro schema: %v", err)
+	}
+
+	// Load SMS-specific configuration
+	cfg, err := config.LoadSmsConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Load message catalogs and SMS templates
+	catalogs, err := i18n.LoadCatalogs(cfg.LocalesDir)
+	if err != nil {
+		log.Fatalf("Failed to load message catalogs: %v", err)
+	}
+
+	templates, err := sms.LoadTemplates(cfg.TemplatesDir, catalogs)
+	if err != nil {
+		log.Fatalf("Failed to load SMS templates: %v", err)
+	}
+
+	// Create Cassandra session
+	cassandraSession, err := cassandra.NewSession(cfg.CassandraConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Cassandra session: %v", err)
+	}
+	defer cassandraSession.Close()
+
+	log.Println("Connected to Cassandra")
+
+	// Initialize SMS gateway
+	var gateway sms.Gateway
+	switch cfg.Gateway {
+	case "webhook":
+		log.Printf("Sending SMS messages via webhook %s", cfg.WebhookURL)
+		gateway = &sms.WebhookGateway{
+			URL:       cfg.WebhookURL,
+			AuthToken: cfg.WebhookAuthToken,
+			Client:    &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		log.Println("Logging SMS messages instead of sending them")
+		gateway = &sms.LoggingGateway{}
+	}
+
+	// Configure Kafka producer for notification status events and dead-lettering commands that can't be processed
+	producer, err := kafka.NewSyncProducer(cfg.KafkaConfig)
+	if err != nil {
+		log.Fatalf("Failed to create Kafka producer: %v", err)
+	}
+	defer producer.Close()
+
+	// Create consumer group
+	group, err := kafka.NewConsumerGroup(cfg.KafkaConfig, "sms-service", sarama.OffsetNewest)
+	if err != nil {
+		log.Fatalf("Failed to create consumer group: %v", err)
+	}
+	defer group.Close()
+
+	// Handle shutdown gracefully
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// Consume messages
+	handler := &delivery.Handler[sms.Message]{
+		Name:        "SMS",
+		ToField:     "toNumber",
+		Decode:      delivery.DecodeBinary(codec),
+		Channel:     &smsChannel{templates: templates, gateway: gateway},
+		SentStore:   &sms.CassandraSentStore{Session: cassandraSession},
+		StatusCodec: statusCodec,
+		Producer:    producer,
+		Retry:       cfg.RetryConfig,
+	}
+	handler.Consume(ctx, group, sms.CommandTopic)
+
+	log.Println("SMS service shutting down...")
+}
+
+// smsChannel renders SMS messages from templates and sends them through the configured gateway
+type smsChannel struct {
+	templates *sms.Templates
+	gateway   sms.Gateway
+}
+
+func (c *smsChannel) Render(req delivery.Request) (sms.Message, error) {
+	msg, err := c.templates.Render(req.TemplateID, req.Locale, req.To, req.Parameters, req.Items)
+	if err != nil {
+		return sms.Message{}, fmt.Errorf("failed to render template %q: %w", req.TemplateID, err)
+	}
+	return msg, nil
+}
+
+func (c *smsChannel) Send(ctx context.Context, msg sms.Message) error {
+	return c.gateway.Send(ctx, msg)
+}
+
+func (c *smsChannel) IsPermanent(err error) bool {
+	return sms.IsPermanent(err)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+)
+
+// Stands in for an SMS provider's webhook during local development, logging the messages it receives
+func main() {
+	addr := flag.String("addr", ":8090", "Address to listen on")
+	responseStatus := flag.Int("status", http.StatusAccepted, "Status code to respond with, e.g. 503 to simulate an outage")
+	flag.Parse()
+
+	http.HandleFunc("POST /messages", func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			To   string `json:"to"`
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			log.Printf("Received invalid message: %v", err)
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Received SMS (responding with %d)\nTo: %s\nBody: %s", *responseStatus, msg.To, msg.Body)
+		w.WriteHeader(*responseStatus)
+	})
+
+	log.Printf("SMS webhook stub listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
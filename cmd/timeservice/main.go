@@ -2,96 +2,296 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/IBM/sarama"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+	"github.com/mattgallagher92/library-book-tracker/internal/lifecycle"
+	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
+	simclockv1 "github.com/mattgallagher92/library-book-tracker/proto/simclock/v1"
+	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/reflection"
-	borrowernotificationv1 "github.com/mattgallagher92/library-book-tracker/proto/borrower_notification/v1"
-	loansv1 "github.com/mattgallagher92/library-book-tracker/proto/loans/v1"
-	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
+	"google.golang.org/grpc/status"
 )
 
+// client is a service registered to receive simulated time
+type client struct {
+	conn *grpc.ClientConn
+	// update sends the state of the simulated clock to the service
+	update func(ctx context.Context, clock timeProvider.Clock) error
+	// failures is the number of consecutive updates that have failed
+	failures int
+}
+
+func newClient(address string) (*client, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	clockClient := simclockv1.NewSimulatedClockClient(conn)
+	return &client{
+		conn: conn,
+		update: func(ctx context.Context, clock timeProvider.Clock) error {
+			_, err := clockClient.Set(ctx, &simclockv1.SetRequest{
+				Timestamp: clock.Time.Format(time.RFC3339Nano),
+				Rate:      clock.Rate,
+				Paused:    clock.Paused,
+			})
+			return err
+		},
+	}, nil
+}
+
+// updateTimeout stops an unresponsive client from holding up updates to the others
+const updateTimeout = 5 * time.Second
+
 type timeServer struct {
 	timev1.UnimplementedTimeServiceServer
-	loansClient              loansv1.LoansServiceClient
-	borrowerNotificationClient borrowernotificationv1.BorrowerNotificationServiceClient
-	currentTime             time.Time
+	// maxFailures is the number of consecutive failed updates after which a client is dropped
+	maxFailures int
+
+	// producer and codec are set when broadcasting time changed events over Kafka
+	producer sarama.SyncProducer
+	codec    *goavro.Codec
+
+	mu      sync.Mutex
+	clients map[string]*client
+	// clock is the source of truth for simulated time, which clients follow
+	clock *timeProvider.SimulatedProvider
 }
 
 func (s *timeServer) SetTime(ctx context.Context, req *timev1.SetTimeRequest) (*timev1.SetTimeResponse, error) {
 	t, err := time.Parse(time.RFC3339, req.Timestamp)
 	if err != nil {
-		return nil, err
-	}
-	
-	// Update loans service time
-	if _, err = s.loansClient.UpdateSimulatedTime(ctx, &loansv1.UpdateSimulatedTimeRequest{
-		Timestamp: req.Timestamp,
-	}); err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.InvalidArgument, "invalid timestamp format: %v", err)
 	}
 
-	// Update borrower notifications service time
-	if _, err = s.borrowerNotificationClient.UpdateSimulatedTime(ctx, &borrowernotificationv1.UpdateSimulatedTimeRequest{
-		Timestamp: req.Timestamp,
-	}); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.update(ctx, s.withTime(t)); err != nil {
 		return nil, err
 	}
-	s.currentTime = t
 	return &timev1.SetTimeResponse{}, nil
 }
 
+// withTime returns the current clock with its time set to t
+func (s *timeServer) withTime(t time.Time) timeProvider.Clock {
+	clock := s.clock.Clock()
+	clock.Time = t
+	return clock
+}
+
+// update broadcasts the clock, if broadcasting over Kafka, and sends it to every registered client, dropping clients
+// that have failed too many times in a row. The time service's own clock is only changed once the broadcast has
+// succeeded. It must be called with s.mu held.
+func (s *timeServer) update(ctx context.Context, clock timeProvider.Clock) error {
+	if s.producer != nil {
+		message, err := timeProvider.NewTimeChangedMessage(s.codec, clock)
+		if err == nil {
+			_, _, err = s.producer.SendMessage(message)
+		}
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "failed to publish time changed event: %v", err)
+		}
+	}
+
+	s.clock.SetClock(clock)
+
+	for address, c := range s.clients {
+		updateCtx, cancel := context.WithTimeout(ctx, updateTimeout)
+		// Send the clock as it is now rather than as it was when the first client was updated, so that slow clients
+		// don't leave later clients behind
+		err := c.update(updateCtx, s.clock.Clock())
+		cancel()
+		if err != nil {
+			c.failures++
+			log.Printf("Failed to update time of %s (%d consecutive failure(s)): %v", address, c.failures, err)
+			if c.failures >= s.maxFailures {
+				log.Printf("Dropping %s after %d consecutive failures", address, c.failures)
+				c.conn.Close()
+				delete(s.clients, address)
+			}
+			continue
+		}
+		c.failures = 0
+	}
+	return nil
+}
+
 func (s *timeServer) AdvanceBy(ctx context.Context, req *timev1.AdvanceByRequest) (*timev1.AdvanceByResponse, error) {
-	newTime := s.currentTime.Add(time.Duration(req.Seconds) * time.Second)
-	timestamp := newTime.Format(time.RFC3339)
-	
-	_, err := s.SetTime(ctx, &timev1.SetTimeRequest{Timestamp: timestamp})
-	if err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newTime := s.clock.Now().Add(time.Duration(req.Seconds) * time.Second)
+	if err := s.update(ctx, s.withTime(newTime)); err != nil {
 		return nil, err
 	}
-	
+
 	return &timev1.AdvanceByResponse{
-		NewTimestamp: timestamp,
+		NewTimestamp: newTime.Format(time.RFC3339),
+	}, nil
+}
+
+func (s *timeServer) RegisterClient(ctx context.Context, req *timev1.RegisterClientRequest) (*timev1.RegisterClientResponse, error) {
+	if req.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "address is required")
+	}
+	c, err := newClient(req.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A service that restarts registers again with the same address
+	if existing, ok := s.clients[req.Address]; ok {
+		existing.conn.Close()
+	}
+	s.clients[req.Address] = c
+	log.Printf("Registered %s client at %s", req.Kind, req.Address)
+
+	// The client sets its clock from the response, so it doesn't need to be sent separately
+	clock := s.clock.Clock()
+	return &timev1.RegisterClientResponse{
+		Timestamp: clock.Time.Format(time.RFC3339Nano),
+		Rate:      clock.Rate,
+		Paused:    clock.Paused,
+	}, nil
+}
+
+// closeClients closes the connections to registered clients. Registrations aren't kept, so once the time service
+// restarts, services register again when their next heartbeat finds that it no longer sends them time.
+func (s *timeServer) closeClients() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, c := range s.clients {
+		c.conn.Close()
+		delete(s.clients, address)
+	}
+	return nil
+}
+
+func (s *timeServer) GetTime(ctx context.Context, req *timev1.GetTimeRequest) (*timev1.GetTimeResponse, error) {
+	clock := s.clock.Clock()
+	return &timev1.GetTimeResponse{
+		Timestamp: clock.Time.Format(time.RFC3339),
+		Rate:      clock.Rate,
+		Paused:    clock.Paused,
 	}, nil
 }
 
+func (s *timeServer) SetRate(ctx context.Context, req *timev1.SetRateRequest) (*timev1.SetRateResponse, error) {
+	if req.Rate <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "rate must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clock := s.clock.Clock()
+	clock.Rate = req.Rate
+	if err := s.update(ctx, clock); err != nil {
+		return nil, err
+	}
+	log.Printf("Simulated time now flows at %g times real time", req.Rate)
+	return &timev1.SetRateResponse{}, nil
+}
+
+func (s *timeServer) Pause(ctx context.Context, req *timev1.PauseRequest) (*timev1.PauseResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clock := s.clock.Clock()
+	clock.Paused = true
+	if err := s.update(ctx, clock); err != nil {
+		return nil, err
+	}
+	log.Printf("Simulated time paused at %s", clock.Time.Format(time.RFC3339))
+	return &timev1.PauseResponse{
+		Timestamp: clock.Time.Format(time.RFC3339),
+	}, nil
+}
+
+func (s *timeServer) Resume(ctx context.Context, req *timev1.ResumeRequest) (*timev1.ResumeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clock := s.clock.Clock()
+	clock.Paused = false
+	if err := s.update(ctx, clock); err != nil {
+		return nil, err
+	}
+	log.Printf("Simulated time resumed from %s", clock.Time.Format(time.RFC3339))
+	return &timev1.ResumeResponse{}, nil
+}
+
 func main() {
 	log.Println("Time coordination service starting...")
 
-	// Connect to loans service
-	loansConn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	cfg, err := config.LoadTimeServiceConfig()
 	if err != nil {
-		log.Fatalf("Failed to connect to loans service: %v", err)
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	defer loansConn.Close()
-	loansClient := loansv1.NewLoansServiceClient(loansConn)
 
-	// Connect to borrower notifications service
-	notificationsConn, err := grpc.Dial("localhost:50053", grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("Failed to connect to borrower notifications service: %v", err)
+	// Shut down cleanly on SIGTERM, so that an update to simulated time isn't cut off part way through sending it to
+	// clients when a pod is replaced
+	service := lifecycle.New(cfg.ShutdownTimeout)
+
+	srv := &timeServer{
+		maxFailures: cfg.MaxClientFailures,
+		clients:     map[string]*client{},
+		clock:       timeProvider.NewSimulatedProvider(time.Now()),
+	}
+
+	if cfg.TimeBroadcast == config.TimeBroadcastKafka {
+		log.Printf("Broadcasting simulated time on %s", timeProvider.TimeChangedTopic)
+		if srv.codec, err = timeProvider.LoadTimeChangedCodec(timeProvider.TimeChangedSchemaPath); err != nil {
+			log.Fatalf("Failed to load time changed Avro schema: %v", err)
+		}
+
+		// Carry on from the last time broadcast, so that restarting the time service doesn't move time
+		latest, ok, err := timeProvider.LatestTimeChanged(cfg.KafkaConfig, srv.codec)
+		if err != nil {
+			log.Fatalf("Failed to read latest simulated time: %v", err)
+		}
+		if ok {
+			srv.clock.SetClock(latest)
+			log.Printf("Resuming from simulated time %s (rate %g, paused %t)",
+				latest.Time.Format(time.RFC3339), latest.Rate, latest.Paused)
+		}
+
+		if srv.producer, err = kafka.NewSyncProducer(cfg.KafkaConfig); err != nil {
+			log.Fatalf("Failed to create Kafka producer: %v", err)
+		}
+		service.OnClose("Kafka producer", srv.producer.Close)
 	}
-	defer notificationsConn.Close()
-	notificationsClient := borrowernotificationv1.NewBorrowerNotificationServiceClient(notificationsConn)
 
-	// Create and start server
+	// Create and start server. Services register themselves at startup, unless following broadcast time.
 	server := grpc.NewServer()
-	timev1.RegisterTimeServiceServer(server, &timeServer{
-		loansClient:              loansClient,
-		borrowerNotificationClient: notificationsClient,
-		currentTime:              time.Now(),
-	})
+	timev1.RegisterTimeServiceServer(server, srv)
+	service.OnClose("client connections", srv.closeClients)
 
-	lis, err := net.Listen("tcp", ":50052")
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
 	reflection.Register(server)
-	log.Printf("Server listening on :50052")
-	if err := server.Serve(lis); err != nil {
+	log.Printf("Server listening on :%d", cfg.Port)
+	if err := service.Serve(server, lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	log.Println("Time coordination service shut down")
 }
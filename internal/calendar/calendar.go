@@ -0,0 +1,165 @@
+package calendar
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/cassandra"
+)
+
+// maxSearchDays stops searches for open days from running forever when the calendar has no open days
+const maxSearchDays = 366
+
+// Hours is the period that the library is open on a day. Times are minutes after midnight in the library's time
+// zone.
+type Hours struct {
+	Opens  int
+	Closes int
+}
+
+// Exception overrides the weekly opening hours on a date, e.g. to close on a bank holiday
+type Exception struct {
+	// Date is in YYYY-MM-DD format
+	Date string
+	// Hours is nil if the library is closed on the date
+	Hours       *Hours
+	Description string
+}
+
+// Calendar records which days the library is open. If no weekly opening hours have been set, the library is treated
+// as open every day other than closed exceptions.
+type Calendar struct {
+	// Weekly holds the usual opening hours; the library is closed on days of the week not present
+	Weekly map[time.Weekday]Hours
+	// Exceptions are keyed by date
+	Exceptions map[string]Exception
+}
+
+// HoursOn returns the opening hours on day, or false if the library is closed. Only day's date is used.
+func (c *Calendar) HoursOn(day time.Time) (Hours, bool) {
+	if exception, ok := c.Exceptions[day.Format(time.DateOnly)]; ok {
+		if exception.Hours == nil {
+			return Hours{}, false
+		}
+		return *exception.Hours, true
+	}
+	if len(c.Weekly) == 0 {
+		return Hours{Opens: 0, Closes: 24 * 60}, true
+	}
+	hours, ok := c.Weekly[day.Weekday()]
+	return hours, ok
+}
+
+func (c *Calendar) IsOpen(day time.Time) bool {
+	_, open := c.HoursOn(day)
+	return open
+}
+
+// StartOfDay returns midnight at the start of t's day in loc, the library's time zone. Days in loc aren't always 24
+// hours long, so days should be counted from it with AddDate rather than by adding durations.
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// DueDate returns the start of the day that something starting at t and lasting days days is due, in loc. It is
+// rolled forward so that nothing is due on a day that the library is closed.
+func (c *Calendar) DueDate(t time.Time, loc *time.Location, days int) time.Time {
+	return c.NextOpenDay(StartOfDay(t, loc).AddDate(0, 0, days))
+}
+
+// NextOpenDay returns day if the library is open on it, otherwise the first day after it that the library is open.
+// If the library isn't open within a year, day is returned.
+func (c *Calendar) NextOpenDay(day time.Time) time.Time {
+	for d, i := day, 0; i < maxSearchDays; d, i = d.AddDate(0, 0, 1), i+1 {
+		if c.IsOpen(d) {
+			return d
+		}
+	}
+	return day
+}
+
+// AddOpenDays returns the day n open days after day, not counting day itself. If the library isn't open n times
+// within a year, the day a year after day is returned.
+func (c *Calendar) AddOpenDays(day time.Time, n int) time.Time {
+	d := day
+	for i := 0; n > 0 && i < maxSearchDays; i++ {
+		d = d.AddDate(0, 0, 1)
+		if c.IsOpen(d) {
+			n--
+		}
+	}
+	return d
+}
+
+// Load reads the calendar from Cassandra
+func Load(session *gocql.Session) (*Calendar, error) {
+	cal := &Calendar{
+		Weekly:     map[time.Weekday]Hours{},
+		Exceptions: map[string]Exception{},
+	}
+
+	var weekday, opens, closes int
+	iter := session.Query(`SELECT weekday, opens, closes FROM opening_hours`).Idempotent(true).Iter()
+	for iter.Scan(&weekday, &opens, &closes) {
+		cal.Weekly[time.Weekday(weekday)] = Hours{Opens: opens, Closes: closes}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	var (
+		day             time.Time
+		exceptionOpens  *int
+		exceptionCloses *int
+		description     string
+	)
+	iter = session.Query(`SELECT day, opens, closes, description FROM calendar_exceptions`).Idempotent(true).Iter()
+	for iter.Scan(&day, &exceptionOpens, &exceptionCloses, &description) {
+		exception := Exception{Date: day.Format(time.DateOnly), Description: description}
+		if exceptionOpens != nil && exceptionCloses != nil {
+			exception.Hours = &Hours{Opens: *exceptionOpens, Closes: *exceptionCloses}
+		}
+		cal.Exceptions[exception.Date] = exception
+		exceptionOpens, exceptionCloses = nil, nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return cal, nil
+}
+
+// SaveWeekly replaces the weekly opening hours
+func SaveWeekly(session *gocql.Session, weekly map[time.Weekday]Hours) error {
+	batch := session.NewBatch(gocql.LoggedBatch)
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if hours, ok := weekly[weekday]; ok {
+			batch.Query(
+				`INSERT INTO opening_hours (weekday, opens, closes) VALUES (?, ?, ?)`,
+				int(weekday), hours.Opens, hours.Closes,
+			)
+		} else {
+			batch.Query(`DELETE FROM opening_hours WHERE weekday = ?`, int(weekday))
+		}
+	}
+	return session.ExecuteBatch(cassandra.MarkIdempotent(batch))
+}
+
+// SaveException adds an exception, replacing any existing exception on the same date
+func SaveException(session *gocql.Session, exception Exception) error {
+	var opens, closes *int
+	if exception.Hours != nil {
+		opens = &exception.Hours.Opens
+		closes = &exception.Hours.Closes
+	}
+	return session.Query(
+		`INSERT INTO calendar_exceptions (day, opens, closes, description) VALUES (?, ?, ?, ?)`,
+		exception.Date, opens, closes, exception.Description,
+	).Idempotent(true).Exec()
+}
+
+// RemoveException removes the exception on date, which is in YYYY-MM-DD format, if there is one
+func RemoveException(session *gocql.Session, date string) error {
+	return session.Query(`DELETE FROM calendar_exceptions WHERE day = ?`, date).Idempotent(true).Exec()
+}
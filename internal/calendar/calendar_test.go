@@ -0,0 +1,115 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+// In Europe/London, clocks go forward from 01:00 GMT to 02:00 BST on 30 March 2025 and back from 02:00 BST to 01:00
+// GMT on 26 October 2025
+func london(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("failed to load Europe/London: %v", err)
+	}
+	return loc
+}
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestStartOfDayAcrossDSTTransitions(t *testing.T) {
+	loc := london(t)
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"before spring forward", utc("2025-03-30T00:30:00Z"), utc("2025-03-30T00:00:00Z")},
+		{"after spring forward", utc("2025-03-30T12:00:00Z"), utc("2025-03-30T00:00:00Z")},
+		// 00:30 BST is still the 30th in UTC, but the 31st in London
+		{"first hour of day after spring forward", utc("2025-03-30T23:30:00Z"), utc("2025-03-30T23:00:00Z")},
+		{"first hour of day of fall back", utc("2025-10-25T23:30:00Z"), utc("2025-10-25T23:00:00Z")},
+		{"repeated hour of fall back", utc("2025-10-26T01:30:00Z"), utc("2025-10-25T23:00:00Z")},
+		{"last hour of day of fall back", utc("2025-10-26T23:30:00Z"), utc("2025-10-25T23:00:00Z")},
+		{"day after fall back", utc("2025-10-27T00:30:00Z"), utc("2025-10-27T00:00:00Z")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StartOfDay(tt.now, loc)
+			if !got.Equal(tt.want) {
+				t.Errorf("StartOfDay(%s) = %s, want %s", tt.now.Format(time.RFC3339), got.UTC().Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+			if got.Location() != loc {
+				t.Errorf("StartOfDay returned a time in %s, want %s", got.Location(), loc)
+			}
+		})
+	}
+}
+
+func TestDueDateAcrossDSTTransitions(t *testing.T) {
+	loc := london(t)
+	openEveryDay := &Calendar{}
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+		// wantUTC is midnight in London on the due date
+		wantUTC time.Time
+	}{
+		{"borrowed before spring forward, due after", utc("2025-03-25T12:00:00Z"), "2025-04-01", utc("2025-03-31T23:00:00Z")},
+		{"borrowed in first hour of a BST day", utc("2025-03-30T23:30:00Z"), "2025-04-07", utc("2025-04-06T23:00:00Z")},
+		{"borrowed before fall back, due after", utc("2025-10-20T12:00:00Z"), "2025-10-27", utc("2025-10-27T00:00:00Z")},
+		{"borrowed in repeated hour of fall back", utc("2025-10-26T01:30:00Z"), "2025-11-02", utc("2025-11-02T00:00:00Z")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := openEveryDay.DueDate(tt.now, loc, 7)
+			if got.Format(time.DateOnly) != tt.want || !got.Equal(tt.wantUTC) {
+				t.Errorf("DueDate(%s) = %s, want midnight on %s", tt.now.Format(time.RFC3339), got.Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestDueDateRollsForwardToOpenDay(t *testing.T) {
+	loc := london(t)
+	cal := &Calendar{
+		Weekly: map[time.Weekday]Hours{time.Monday: {Opens: 9 * 60, Closes: 17 * 60}},
+		Exceptions: map[string]Exception{
+			"2025-03-31": {Date: "2025-03-31", Description: "Closed"},
+		},
+	}
+	// Seven days after Sunday 23 March is Sunday 30 March, when the clocks change; the next Monday is closed
+	got := cal.DueDate(utc("2025-03-23T12:00:00Z"), loc, 7)
+	if want := utc("2025-04-06T23:00:00Z"); !got.Equal(want) {
+		t.Errorf("DueDate = %s, want %s", got.Format(time.RFC3339), want.In(loc).Format(time.RFC3339))
+	}
+}
+
+func TestAddOpenDaysAcrossDSTTransitions(t *testing.T) {
+	loc := london(t)
+	openEveryDay := &Calendar{}
+	tests := []struct {
+		name  string
+		today time.Time
+		want  time.Time
+	}{
+		{"spring forward", StartOfDay(utc("2025-03-29T12:00:00Z"), loc), utc("2025-03-30T23:00:00Z")},
+		{"fall back", StartOfDay(utc("2025-10-25T12:00:00Z"), loc), utc("2025-10-27T00:00:00Z")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := openEveryDay.AddOpenDays(tt.today, 2)
+			if !got.Equal(tt.want) {
+				t.Errorf("AddOpenDays(%s, 2) = %s, want %s", tt.today.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.In(loc).Format(time.RFC3339))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package cassandra
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+)
+
+// NewSession connects to Cassandra with the settings shared by every service
+func NewSession(cfg config.CassandraConfig) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(cfg.CassandraHosts...)
+	cluster.Keyspace = cfg.Keyspace
+	cluster.Consistency = cfg.CassandraConsistency
+	cluster.Timeout = cfg.CassandraTimeout
+	cluster.ConnectTimeout = cfg.CassandraConnectTimeout
+
+	if cfg.CassandraUsername != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cfg.CassandraUsername,
+			Password: cfg.CassandraPassword,
+		}
+	}
+
+	if cfg.CassandraTLS {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 cfg.CassandraTLSCAFile,
+			CertPath:               cfg.CassandraTLSCertFile,
+			KeyPath:                cfg.CassandraTLSKeyFile,
+			EnableHostVerification: true,
+		}
+	}
+
+	// Token awareness sends queries straight to a replica that owns the data
+	if cfg.CassandraLocalDC != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(cfg.CassandraLocalDC))
+	} else {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+	}
+
+	cluster.RetryPolicy = &idempotentRetryPolicy{backoff: &gocql.ExponentialBackoffRetryPolicy{
+		NumRetries: cfg.CassandraRetries,
+		Min:        cfg.CassandraRetryMinBackoff,
+		Max:        cfg.CassandraRetryMaxBackoff,
+	}}
+
+	return cluster.CreateSession()
+}
+
+// MarkIdempotent marks every statement in batch as idempotent, so that the batch is retried if it fails. Only batches
+// of plain writes should be marked; counter updates and lightweight transactions could be applied twice.
+func MarkIdempotent(batch *gocql.Batch) *gocql.Batch {
+	for i := range batch.Entries {
+		batch.Entries[i].Idempotent = true
+	}
+	return batch
+}
+
+// idempotentRetryPolicy retries only queries and batches marked as idempotent, backing off exponentially between
+// attempts. gocql applies the cluster's retry policy to every query, so without it a counter update or lightweight
+// transaction that timed out after being applied would be applied again.
+type idempotentRetryPolicy struct {
+	backoff *gocql.ExponentialBackoffRetryPolicy
+}
+
+func (p *idempotentRetryPolicy) Attempt(q gocql.RetryableQuery) bool {
+	idempotent, ok := q.(interface{ IsIdempotent() bool })
+	return ok && idempotent.IsIdempotent() && p.backoff.Attempt(q)
+}
+
+func (p *idempotentRetryPolicy) GetRetryType(err error) gocql.RetryType {
+	return p.backoff.GetRetryType(err)
+}
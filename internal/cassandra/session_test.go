@@ -0,0 +1,46 @@
+package cassandra
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+// testQuery is a gocql.RetryableQuery that has been attempted attempts times
+type testQuery struct {
+	attempts   int
+	idempotent bool
+}
+
+func (q *testQuery) Attempts() int                     { return q.attempts }
+func (q *testQuery) SetConsistency(gocql.Consistency)  {}
+func (q *testQuery) GetConsistency() gocql.Consistency { return gocql.Quorum }
+func (q *testQuery) Context() context.Context          { return context.Background() }
+func (q *testQuery) IsIdempotent() bool                { return q.idempotent }
+
+func TestOnlyIdempotentQueriesAreRetried(t *testing.T) {
+	policy := &idempotentRetryPolicy{backoff: &gocql.ExponentialBackoffRetryPolicy{NumRetries: 3}}
+
+	if !policy.Attempt(&testQuery{attempts: 1, idempotent: true}) {
+		t.Errorf("idempotent query wasn't retried")
+	}
+	if policy.Attempt(&testQuery{attempts: 4, idempotent: true}) {
+		t.Errorf("idempotent query was retried more than NumRetries times")
+	}
+	if policy.Attempt(&testQuery{attempts: 1, idempotent: false}) {
+		t.Errorf("query that isn't idempotent, e.g. a counter update, was retried")
+	}
+}
+
+func TestMarkIdempotentMarksEveryStatement(t *testing.T) {
+	batch := &gocql.Batch{Type: gocql.LoggedBatch}
+	batch.Query(`INSERT INTO a (id) VALUES (?)`, 1)
+	batch.Query(`INSERT INTO b (id) VALUES (?)`, 1)
+	if batch.IsIdempotent() {
+		t.Fatalf("batch statements are idempotent before being marked")
+	}
+	if !MarkIdempotent(batch).IsIdempotent() {
+		t.Errorf("batch isn't idempotent after being marked")
+	}
+}
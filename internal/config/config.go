@@ -3,73 +3,484 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
+	// Embed the time zone database, as the service images don't include one
+	_ "time/tzdata"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraConfig contains the settings for connecting to Cassandra shared by every service that uses it
+type CassandraConfig struct {
+	CassandraHosts []string
+	Keyspace       string
+	// CassandraConsistency is the consistency level of queries, QUORUM by default
+	CassandraConsistency gocql.Consistency
+	// CassandraTimeout limits how long a query waits for a response
+	CassandraTimeout time.Duration
+	// CassandraConnectTimeout limits how long connecting to a node takes
+	CassandraConnectTimeout time.Duration
+	// CassandraUsername and CassandraPassword are used for password authentication if CassandraUsername is set
+	CassandraUsername string
+	CassandraPassword string
+	// CassandraTLS enables TLS. The nodes' certificates are verified against CassandraTLSCAFile, or the system's
+	// roots if it isn't set, and CassandraTLSCertFile and CassandraTLSKeyFile are the client certificate, if any.
+	CassandraTLS         bool
+	CassandraTLSCAFile   string
+	CassandraTLSCertFile string
+	CassandraTLSKeyFile  string
+	// CassandraLocalDC is the data center that queries are sent to in preference to others, if set
+	CassandraLocalDC string
+	// CassandraRetries is how many times a failed query marked as idempotent is retried, waiting between
+	// CassandraRetryMinBackoff and CassandraRetryMaxBackoff
+	CassandraRetries         int
+	CassandraRetryMinBackoff time.Duration
+	CassandraRetryMaxBackoff time.Duration
+}
+
+// SASL mechanisms that Kafka clients can authenticate with
+const (
+	KafkaSASLPlain       = "PLAIN"
+	KafkaSASLSCRAMSHA256 = "SCRAM-SHA-256"
+	KafkaSASLSCRAMSHA512 = "SCRAM-SHA-512"
 )
 
+// KafkaConfig contains the settings for connecting to Kafka shared by every service that uses it
+type KafkaConfig struct {
+	KafkaBrokers []string
+	// KafkaClientID identifies the service in broker logs and quotas
+	KafkaClientID string
+	// KafkaSASLMechanism is empty if SASL isn't used, otherwise KafkaSASLPlain, KafkaSASLSCRAMSHA256 or
+	// KafkaSASLSCRAMSHA512
+	KafkaSASLMechanism string
+	KafkaSASLUsername  string
+	KafkaSASLPassword  string
+	// KafkaTLS enables TLS. The brokers' certificates are verified against KafkaTLSCAFile, or the system's roots if it
+	// isn't set, and KafkaTLSCertFile and KafkaTLSKeyFile are the client certificate, if any.
+	KafkaTLS         bool
+	KafkaTLSCAFile   string
+	KafkaTLSCertFile string
+	KafkaTLSKeyFile  string
+	// KafkaCompression is the codec that producers compress messages with: none, gzip, snappy, lz4 or zstd
+	KafkaCompression string
+	// KafkaIdempotentProducer stops producer retries from writing duplicate messages
+	KafkaIdempotentProducer bool
+	// KafkaRebalanceStrategy is how consumer groups assign partitions: roundrobin, range or sticky
+	KafkaRebalanceStrategy string
+	// KafkaSessionTimeout is how long a consumer can go without heartbeating before it is removed from its group
+	KafkaSessionTimeout    time.Duration
+	KafkaHeartbeatInterval time.Duration
+}
+
 // EmailConfig contains configuration specific to the email service
 type EmailConfig struct {
-	KafkaBrokers []string
+	CassandraConfig
+	KafkaConfig
+	// Sender is either "smtp" to deliver emails or "maildir" to capture them in CaptureDir
+	Sender       string
+	FromAddress  string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPStartTLS bool
+	SMTPUsername string
+	SMTPPassword string
+	CaptureDir   string
+	TemplatesDir string
+	LocalesDir   string
+	RetryConfig
+}
+
+// SmsConfig contains configuration specific to the SMS service
+type SmsConfig struct {
+	CassandraConfig
+	KafkaConfig
+	// Gateway is either "webhook" to deliver messages via WebhookURL or "logging" to just log them
+	Gateway          string
+	WebhookURL       string
+	WebhookAuthToken string
+	TemplatesDir     string
+	LocalesDir       string
+	RetryConfig
+}
+
+// RetryConfig controls how failed deliveries are retried before being dead-lettered
+type RetryConfig struct {
+	// MaxAttempts is the number of times to try delivering a message before dead-lettering it
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DLQReplayConfig contains configuration specific to the dead letter replay command
+type DLQReplayConfig struct {
+	KafkaConfig
+}
+
+// BackfillConfig contains configuration specific to the loans by due day backfill command
+type BackfillConfig struct {
+	CassandraConfig
+	// TimeZone is the library's time zone, in which loans are due at the start of a day
+	TimeZone *time.Location
 }
 
 // LoansConfig contains configuration specific to the loans service
 type LoansConfig struct {
-	CassandraHosts []string
-	Keyspace       string
+	CassandraConfig
+	// Port is the port that the gRPC server listens on
+	Port int
+	// ShutdownTimeout is how long in-flight requests and background work get to finish on shutdown
+	ShutdownTimeout time.Duration
+	// TimeZone is the library's time zone, in which loans are due at the start of a day
+	TimeZone *time.Location
+	// Env is the environment that the service runs in; gRPC reflection is enabled unless it is EnvProduction
+	Env string
+	SimulatedTimeConfig
+}
+
+// EnvProduction is the environment that services run in when deployed for real
+const EnvProduction = "production"
+
+// Ways that the time service can send simulated time to services
+const (
+	// TimeBroadcastGRPC means services register with the time service, which calls each of them when time changes
+	TimeBroadcastGRPC = "grpc"
+	// TimeBroadcastKafka means the time service publishes time changed events, which every replica consumes
+	TimeBroadcastKafka = "kafka"
+)
+
+// SimulatedTimeConfig contains configuration for services that receive simulated time from the time service
+type SimulatedTimeConfig struct {
+	// SimulateTime makes the service use the time service's simulated time rather than the system's
+	SimulateTime bool
+	// TimeBroadcast is either TimeBroadcastGRPC or TimeBroadcastKafka
+	TimeBroadcast      string
+	TimeServiceAddress string
+	// AdvertiseAddress is the address that the time service should use to reach this service
+	AdvertiseAddress string
+	// BroadcastKafka is used to consume time changed events
+	BroadcastKafka KafkaConfig
+}
+
+// TimeServiceConfig contains configuration specific to the time service
+type TimeServiceConfig struct {
+	// Port is the port that the gRPC server listens on
+	Port int
+	// ShutdownTimeout is how long in-flight requests and background work get to finish on shutdown
+	ShutdownTimeout time.Duration
+	// TimeBroadcast is either TimeBroadcastGRPC or TimeBroadcastKafka
+	TimeBroadcast string
+	// MaxClientFailures is the number of consecutive failed updates after which a client is dropped
+	MaxClientFailures int
+	KafkaConfig
 }
 
 // NotificationsConfig contains configuration specific to the notifications service
 type NotificationsConfig struct {
-	CassandraHosts []string
-	Keyspace       string
-	KafkaBrokers   []string
+	CassandraConfig
+	KafkaConfig
+	// Port is the port that the gRPC server listens on
+	Port int
+	// ShutdownTimeout is how long in-flight requests and background work get to finish on shutdown
+	ShutdownTimeout time.Duration
+	// TimeZone is the library's time zone, which due days, quiet hours and dates in notifications are in
+	TimeZone *time.Location
+	// Env is the environment that the service runs in; gRPC reflection is enabled unless it is EnvProduction
+	Env string
+	SimulatedTimeConfig
+	// InstanceID identifies this replica when competing to be the leader that checks for due loans
+	InstanceID string
+	// LeaseTTL is how long the leader keeps the lease without renewing it, i.e. the longest that checks can stop for
+	// if the leader fails
+	LeaseTTL time.Duration
+	// MaxCatchUpDays is how many days before its horizon a due loan check as of a later date catches up on. Periodic
+	// checks catch up on every day from today, as earlier loans are already overdue.
+	MaxCatchUpDays int
 }
 
+// LoadEmailConfig, like the other Load functions, reads environment variables, falling back to the JSON or YAML file
+// named by CONFIG_FILE, and reports every invalid setting together
 func LoadEmailConfig() (*EmailConfig, error) {
-	brokers := os.Getenv("KAFKA_BROKERS")
-	if brokers == "" {
-		return nil, fmt.Errorf("KAFKA_BROKERS environment variable is required")
+	l := newLoader()
+	cfg := &EmailConfig{
+		CassandraConfig: loadCassandraConfig(l),
+		KafkaConfig:     loadKafkaConfig(l, "email-service"),
+		Sender:          l.oneOf("EMAIL_SENDER", "maildir", "smtp", "maildir"),
+		FromAddress:     l.string("EMAIL_FROM_ADDRESS", "library@example.com"),
+		TemplatesDir:    l.string("EMAIL_TEMPLATES_DIR", "templates/email"),
+		LocalesDir:      l.string("LOCALES_DIR", "templates/locales"),
+		RetryConfig:     loadRetryConfig(l, "EMAIL"),
+	}
+
+	switch cfg.Sender {
+	case "smtp":
+		cfg.SMTPHost = l.string("SMTP_HOST", "")
+		if cfg.SMTPHost == "" {
+			l.errorf("SMTP_HOST environment variable is required when EMAIL_SENDER is smtp")
+		}
+		cfg.SMTPPort = l.port("SMTP_PORT", 587)
+		cfg.SMTPStartTLS = l.bool("SMTP_STARTTLS", true)
+		cfg.SMTPUsername = l.string("SMTP_USERNAME", "")
+		cfg.SMTPPassword = l.string("SMTP_PASSWORD", "")
+	case "maildir":
+		cfg.CaptureDir = l.string("EMAIL_CAPTURE_DIR", "maildir")
 	}
 
-	return &EmailConfig{
-		KafkaBrokers: []string{brokers}, // For now just support single broker
-	}, nil
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadSmsConfig() (*SmsConfig, error) {
+	l := newLoader()
+	cfg := &SmsConfig{
+		CassandraConfig: loadCassandraConfig(l),
+		KafkaConfig:     loadKafkaConfig(l, "sms-service"),
+		Gateway:         l.oneOf("SMS_GATEWAY", "logging", "webhook", "logging"),
+		TemplatesDir:    l.string("SMS_TEMPLATES_DIR", "templates/sms"),
+		LocalesDir:      l.string("LOCALES_DIR", "templates/locales"),
+		RetryConfig:     loadRetryConfig(l, "SMS"),
+	}
+
+	if cfg.Gateway == "webhook" {
+		cfg.WebhookURL = l.string("SMS_WEBHOOK_URL", "")
+		if cfg.WebhookURL == "" {
+			l.errorf("SMS_WEBHOOK_URL environment variable is required when SMS_GATEWAY is webhook")
+		}
+		cfg.WebhookAuthToken = l.string("SMS_WEBHOOK_AUTH_TOKEN", "")
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadCassandraConfig reads CASSANDRA_HOSTS, a comma-separated list, CASSANDRA_KEYSPACE and the other CASSANDRA_
+// settings
+func loadCassandraConfig(l *loader) CassandraConfig {
+	cfg := CassandraConfig{
+		CassandraHosts:           l.requiredList("CASSANDRA_HOSTS"),
+		Keyspace:                 l.requiredString("CASSANDRA_KEYSPACE"),
+		CassandraConsistency:     gocql.Quorum,
+		CassandraTimeout:         l.duration("CASSANDRA_TIMEOUT", 11*time.Second, time.Millisecond),
+		CassandraConnectTimeout:  l.duration("CASSANDRA_CONNECT_TIMEOUT", 11*time.Second, time.Millisecond),
+		CassandraUsername:        l.string("CASSANDRA_USERNAME", ""),
+		CassandraPassword:        l.string("CASSANDRA_PASSWORD", ""),
+		CassandraTLS:             l.bool("CASSANDRA_TLS", false),
+		CassandraTLSCAFile:       l.string("CASSANDRA_TLS_CA_FILE", ""),
+		CassandraTLSCertFile:     l.string("CASSANDRA_TLS_CERT_FILE", ""),
+		CassandraTLSKeyFile:      l.string("CASSANDRA_TLS_KEY_FILE", ""),
+		CassandraLocalDC:         l.string("CASSANDRA_LOCAL_DC", ""),
+		CassandraRetries:         l.int("CASSANDRA_RETRIES", 3, 0),
+		CassandraRetryMinBackoff: l.duration("CASSANDRA_RETRY_MIN_BACKOFF", 100*time.Millisecond, 0),
+		CassandraRetryMaxBackoff: l.duration("CASSANDRA_RETRY_MAX_BACKOFF", 2*time.Second, 0),
+	}
+
+	if cfg.CassandraPassword != "" && cfg.CassandraUsername == "" {
+		l.errorf("CASSANDRA_USERNAME environment variable is required when CASSANDRA_PASSWORD is set")
+	}
+	if (cfg.CassandraTLSCertFile == "") != (cfg.CassandraTLSKeyFile == "") {
+		l.errorf("CASSANDRA_TLS_CERT_FILE and CASSANDRA_TLS_KEY_FILE must be set together")
+	}
+	if !cfg.CassandraTLS && (cfg.CassandraTLSCAFile != "" || cfg.CassandraTLSCertFile != "") {
+		l.errorf("CASSANDRA_TLS must be true when TLS files are set")
+	}
+	if cfg.CassandraRetryMaxBackoff < cfg.CassandraRetryMinBackoff {
+		l.errorf("CASSANDRA_RETRY_MAX_BACKOFF must be at least CASSANDRA_RETRY_MIN_BACKOFF")
+	}
+
+	if value, ok := l.lookup("CASSANDRA_CONSISTENCY"); ok {
+		consistency, err := gocql.ParseConsistencyWrapper(strings.ToUpper(value))
+		if err != nil {
+			l.errorf("CASSANDRA_CONSISTENCY must be a consistency level such as QUORUM or LOCAL_QUORUM, got %q", value)
+		} else {
+			cfg.CassandraConsistency = consistency
+		}
+	}
+
+	return cfg
+}
+
+// loadKafkaConfig reads KAFKA_BROKERS, a comma-separated list, and the other KAFKA_ settings. The client ID is
+// clientID unless KAFKA_CLIENT_ID is set.
+func loadKafkaConfig(l *loader, clientID string) KafkaConfig {
+	cfg := KafkaConfig{
+		KafkaBrokers:            l.requiredList("KAFKA_BROKERS"),
+		KafkaClientID:           l.string("KAFKA_CLIENT_ID", clientID),
+		KafkaSASLMechanism:      l.string("KAFKA_SASL_MECHANISM", ""),
+		KafkaSASLUsername:       l.string("KAFKA_SASL_USERNAME", ""),
+		KafkaSASLPassword:       l.string("KAFKA_SASL_PASSWORD", ""),
+		KafkaTLS:                l.bool("KAFKA_TLS", false),
+		KafkaTLSCAFile:          l.string("KAFKA_TLS_CA_FILE", ""),
+		KafkaTLSCertFile:        l.string("KAFKA_TLS_CERT_FILE", ""),
+		KafkaTLSKeyFile:         l.string("KAFKA_TLS_KEY_FILE", ""),
+		KafkaCompression:        l.oneOf("KAFKA_COMPRESSION", "none", "none", "gzip", "snappy", "lz4", "zstd"),
+		KafkaIdempotentProducer: l.bool("KAFKA_IDEMPOTENT_PRODUCER", false),
+		KafkaRebalanceStrategy:  l.oneOf("KAFKA_REBALANCE_STRATEGY", "roundrobin", "roundrobin", "range", "sticky"),
+		KafkaSessionTimeout:     l.duration("KAFKA_SESSION_TIMEOUT", 10*time.Second, time.Second),
+		KafkaHeartbeatInterval:  l.duration("KAFKA_HEARTBEAT_INTERVAL", 3*time.Second, 100*time.Millisecond),
+	}
+
+	switch cfg.KafkaSASLMechanism {
+	case "", KafkaSASLPlain, KafkaSASLSCRAMSHA256, KafkaSASLSCRAMSHA512:
+	default:
+		l.errorf("KAFKA_SASL_MECHANISM must be %s, %s or %s, got %q",
+			KafkaSASLPlain, KafkaSASLSCRAMSHA256, KafkaSASLSCRAMSHA512, cfg.KafkaSASLMechanism)
+	}
+	if cfg.KafkaSASLMechanism != "" && cfg.KafkaSASLUsername == "" {
+		l.errorf("KAFKA_SASL_USERNAME environment variable is required when KAFKA_SASL_MECHANISM is set")
+	}
+	if (cfg.KafkaTLSCertFile == "") != (cfg.KafkaTLSKeyFile == "") {
+		l.errorf("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if !cfg.KafkaTLS && (cfg.KafkaTLSCAFile != "" || cfg.KafkaTLSCertFile != "") {
+		l.errorf("KAFKA_TLS must be true when TLS files are set")
+	}
+	if cfg.KafkaHeartbeatInterval >= cfg.KafkaSessionTimeout {
+		l.errorf("KAFKA_HEARTBEAT_INTERVAL must be less than KAFKA_SESSION_TIMEOUT")
+	}
+
+	return cfg
+}
+
+// loadRetryConfig reads <prefix>_MAX_ATTEMPTS, <prefix>_INITIAL_BACKOFF and <prefix>_MAX_BACKOFF
+func loadRetryConfig(l *loader, prefix string) RetryConfig {
+	cfg := RetryConfig{
+		MaxAttempts:    l.int(prefix+"_MAX_ATTEMPTS", 5, 1),
+		InitialBackoff: l.duration(prefix+"_INITIAL_BACKOFF", time.Second, 0),
+		MaxBackoff:     l.duration(prefix+"_MAX_BACKOFF", time.Minute, 0),
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		l.errorf("%s_MAX_BACKOFF must be at least %s_INITIAL_BACKOFF", prefix, prefix)
+	}
+	return cfg
+}
+
+func LoadDLQReplayConfig() (*DLQReplayConfig, error) {
+	l := newLoader()
+	cfg := &DLQReplayConfig{
+		KafkaConfig: loadKafkaConfig(l, "dlq-replay"),
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadBackfillConfig() (*BackfillConfig, error) {
+	l := newLoader()
+	cfg := &BackfillConfig{
+		CassandraConfig: loadCassandraConfig(l),
+		TimeZone:        loadTimeZone(l),
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 func LoadLoansConfig() (*LoansConfig, error) {
-	hosts := os.Getenv("CASSANDRA_HOSTS")
-	if hosts == "" {
-		return nil, fmt.Errorf("CASSANDRA_HOSTS environment variable is required")
+	l := newLoader()
+	cfg := &LoansConfig{
+		CassandraConfig: loadCassandraConfig(l),
+		Port:            l.port("LOANS_PORT", 50051),
+		ShutdownTimeout: l.duration("SHUTDOWN_TIMEOUT", 20*time.Second, 0),
+		TimeZone:        loadTimeZone(l),
+		Env:             l.string("ENV", ""),
 	}
+	cfg.SimulatedTimeConfig = loadSimulatedTimeConfig(l, cfg.Port, "loans")
 
-	keyspace := os.Getenv("CASSANDRA_KEYSPACE")
-	if keyspace == "" {
-		return nil, fmt.Errorf("CASSANDRA_KEYSPACE environment variable is required")
+	if err := l.err(); err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
 
-	return &LoansConfig{
-		CassandraHosts: []string{hosts}, // For now just support single host
-		Keyspace:       keyspace,
-	}, nil
+// loadTimeZone reads LIBRARY_TIME_ZONE, which services that work in whole days must agree on
+func loadTimeZone(l *loader) *time.Location {
+	name := l.string("LIBRARY_TIME_ZONE", "Europe/London")
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		l.errorf("LIBRARY_TIME_ZONE must be an IANA time zone name: %w", err)
+		return time.UTC
+	}
+	return loc
 }
 
-func LoadNotificationsConfig() (*NotificationsConfig, error) {
-	hosts := os.Getenv("CASSANDRA_HOSTS")
-	if hosts == "" {
-		return nil, fmt.Errorf("CASSANDRA_HOSTS environment variable is required")
+// loadSimulatedTimeConfig reads the settings for receiving simulated time. By default, the time service reaches this
+// service on localhost at port.
+func loadSimulatedTimeConfig(l *loader, port int, kafkaClientID string) SimulatedTimeConfig {
+	cfg := SimulatedTimeConfig{
+		SimulateTime:       l.bool("SIMULATE_TIME", false),
+		TimeBroadcast:      l.oneOf("TIME_BROADCAST", TimeBroadcastGRPC, TimeBroadcastGRPC, TimeBroadcastKafka),
+		TimeServiceAddress: l.string("TIME_SERVICE_ADDRESS", "localhost:50052"),
+		AdvertiseAddress:   l.string("ADVERTISE_ADDRESS", fmt.Sprintf("localhost:%d", port)),
+	}
+
+	if cfg.TimeBroadcast == TimeBroadcastKafka {
+		if _, ok := l.lookup("KAFKA_BROKERS"); !ok {
+			l.errorf("KAFKA_BROKERS environment variable is required when TIME_BROADCAST is kafka")
+		} else {
+			cfg.BroadcastKafka = loadKafkaConfig(l, kafkaClientID)
+		}
 	}
 
-	keyspace := os.Getenv("CASSANDRA_KEYSPACE")
-	if keyspace == "" {
-		return nil, fmt.Errorf("CASSANDRA_KEYSPACE environment variable is required")
+	return cfg
+}
+
+func LoadTimeServiceConfig() (*TimeServiceConfig, error) {
+	l := newLoader()
+	cfg := &TimeServiceConfig{
+		Port:              l.port("TIME_SERVICE_PORT", 50052),
+		ShutdownTimeout:   l.duration("SHUTDOWN_TIMEOUT", 20*time.Second, 0),
+		TimeBroadcast:     l.oneOf("TIME_BROADCAST", TimeBroadcastGRPC, TimeBroadcastGRPC, TimeBroadcastKafka),
+		MaxClientFailures: l.int("TIME_MAX_CLIENT_FAILURES", 3, 1),
+	}
+
+	if cfg.TimeBroadcast == TimeBroadcastKafka {
+		if _, ok := l.lookup("KAFKA_BROKERS"); !ok {
+			l.errorf("KAFKA_BROKERS environment variable is required when TIME_BROADCAST is kafka")
+		} else {
+			cfg.KafkaConfig = loadKafkaConfig(l, "time-service")
+		}
 	}
 
-	brokers := os.Getenv("KAFKA_BROKERS")
-	if brokers == "" {
-		return nil, fmt.Errorf("KAFKA_BROKERS environment variable is required")
+	if err := l.err(); err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
 
-	return &NotificationsConfig{
-		CassandraHosts: []string{hosts}, // For now just support single host
-		Keyspace:       keyspace,
-		KafkaBrokers:   []string{brokers}, // For now just support single broker
-	}, nil
+func LoadNotificationsConfig() (*NotificationsConfig, error) {
+	l := newLoader()
+	cfg := &NotificationsConfig{
+		CassandraConfig: loadCassandraConfig(l),
+		KafkaConfig:     loadKafkaConfig(l, "borrower-notifications"),
+		Port:            l.port("NOTIFICATIONS_PORT", 50053),
+		ShutdownTimeout: l.duration("SHUTDOWN_TIMEOUT", 20*time.Second, 0),
+		TimeZone:        loadTimeZone(l),
+		Env:             l.string("ENV", ""),
+		InstanceID:      l.string("INSTANCE_ID", ""),
+		LeaseTTL:        l.duration("NOTIFICATIONS_LEASE_TTL", 30*time.Second, 3*time.Second),
+		MaxCatchUpDays:  l.int("NOTIFICATIONS_MAX_CATCH_UP_DAYS", 7, 0),
+	}
+	cfg.SimulatedTimeConfig = loadSimulatedTimeConfig(l, cfg.Port, "borrower-notifications")
+
+	// Pods' hostnames are their names, which are unique
+	if cfg.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			l.errorf("INSTANCE_ID environment variable is required when the hostname is unknown: %w", err)
+		}
+		cfg.InstanceID = hostname
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
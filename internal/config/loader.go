@@ -0,0 +1,220 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loader reads settings from environment variables, falling back to the file named by CONFIG_FILE, if any. It
+// collects every invalid setting, so that they can all be reported together at startup rather than one per restart.
+type loader struct {
+	file map[string]string
+	errs []error
+}
+
+func newLoader() *loader {
+	l := &loader{file: map[string]string{}}
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return l
+	}
+	file, err := readConfigFile(path)
+	if err != nil {
+		l.errorf("CONFIG_FILE %s could not be read: %w", path, err)
+		return l
+	}
+	l.file = file
+	return l
+}
+
+// readConfigFile reads a JSON or YAML file, depending on its extension, holding an object whose keys are the names
+// of environment variables. Lists may be given as arrays or comma-separated strings.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		// Numbers are kept as written rather than read as floats, which would format large ones like 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err = decoder.Decode(&raw); err == nil {
+			if _, extra := decoder.Token(); extra != io.EOF {
+				err = errors.New("unexpected data after the top-level object")
+			}
+		}
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q; expected .json, .yaml or .yml", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := map[string]string{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = formatValue(item)
+			}
+			file[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			file[key] = formatValue(v)
+		}
+	}
+	return file, nil
+}
+
+// formatValue formats a value read from a config file as it would be written in an environment variable
+func formatValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		// YAML floats; the shortest form that reads back the same, without an exponent
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// errorf records an invalid setting. Settings read by more than one part of a service's configuration, such as
+// KAFKA_BROKERS, are only reported once.
+func (l *loader) errorf(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	for _, existing := range l.errs {
+		if existing.Error() == err.Error() {
+			return
+		}
+	}
+	l.errs = append(l.errs, err)
+}
+
+// err returns every invalid setting found so far, or nil if there were none
+func (l *loader) err() error {
+	return errors.Join(l.errs...)
+}
+
+// lookup returns the setting from the environment, or the config file if it isn't set there
+func (l *loader) lookup(key string) (string, bool) {
+	if value := os.Getenv(key); value != "" {
+		return value, true
+	}
+	value, ok := l.file[key]
+	return value, ok && value != ""
+}
+
+func (l *loader) string(key, defaultValue string) string {
+	if value, ok := l.lookup(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (l *loader) requiredString(key string) string {
+	value, ok := l.lookup(key)
+	if !ok {
+		l.errorf("%s environment variable is required", key)
+	}
+	return value
+}
+
+// oneOf reads a setting that must be one of options
+func (l *loader) oneOf(key, defaultValue string, options ...string) string {
+	value := l.string(key, defaultValue)
+	for _, option := range options {
+		if value == option {
+			return value
+		}
+	}
+	l.errorf("%s must be %s, got %q", key, strings.Join(options, " or "), value)
+	return value
+}
+
+// requiredList reads a comma-separated list, ignoring whitespace around items
+func (l *loader) requiredList(key string) []string {
+	value, ok := l.lookup(key)
+	if !ok {
+		l.errorf("%s environment variable is required", key)
+		return nil
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		l.errorf("%s must list at least one item", key)
+	}
+	return items
+}
+
+// int reads a setting that must be at least min
+func (l *loader) int(key string, defaultValue, min int) int {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		l.errorf("%s must be a number no less than %d, got %q", key, min, value)
+		return defaultValue
+	}
+	return n
+}
+
+// port reads a TCP port number
+func (l *loader) port(key string, defaultValue int) int {
+	port := l.int(key, defaultValue, 1)
+	if port > 65535 {
+		l.errorf("%s must be a port number no greater than 65535, got %d", key, port)
+	}
+	return port
+}
+
+func (l *loader) bool(key string, defaultValue bool) bool {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.errorf("%s must be true or false, got %q", key, value)
+		return defaultValue
+	}
+	return b
+}
+
+// duration reads a setting in time.ParseDuration's format that must be at least min
+func (l *loader) duration(key string, defaultValue, min time.Duration) time.Duration {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		l.errorf("%s must be a duration: %w", key, err)
+		return defaultValue
+	}
+	if d < min {
+		l.errorf("%s must be at least %s, got %s", key, min, d)
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// No settings are fractional yet, but readConfigFile doesn't know which settings exist
+func TestReadConfigFileKeepsNumbersAsWritten(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+			"NOTIFICATIONS_MAX_CATCH_UP_DAYS": 1000000,
+			"EXAMPLE_FRACTION": 2.5,
+			"TIME_MAX_CLIENT_FAILURES": 1440,
+			"KAFKA_BROKERS": ["kafka-0:9092", "kafka-1:9092"],
+			"SMTP_STARTTLS": true,
+			"CASSANDRA_USERNAME": null
+		}`,
+		"config.yaml": `
+NOTIFICATIONS_MAX_CATCH_UP_DAYS: 1000000
+EXAMPLE_FRACTION: 2.5
+TIME_MAX_CLIENT_FAILURES: 1440.0
+KAFKA_BROKERS:
+  - kafka-0:9092
+  - kafka-1:9092
+SMTP_STARTTLS: true
+CASSANDRA_USERNAME:
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			file, err := readConfigFile(writeConfigFile(t, name, contents))
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", name, err)
+			}
+			want := map[string]string{
+				"NOTIFICATIONS_MAX_CATCH_UP_DAYS": "1000000",
+				"EXAMPLE_FRACTION":                "2.5",
+				"TIME_MAX_CLIENT_FAILURES":        "1440",
+				"KAFKA_BROKERS":                   "kafka-0:9092,kafka-1:9092",
+				"SMTP_STARTTLS":                   "true",
+			}
+			for key, value := range want {
+				if file[key] != value {
+					t.Errorf("%s = %q, want %q", key, file[key], value)
+				}
+			}
+			if _, ok := file["CASSANDRA_USERNAME"]; ok {
+				t.Errorf("null setting CASSANDRA_USERNAME was read as %q", file["CASSANDRA_USERNAME"])
+			}
+		})
+	}
+}
+
+func TestReadConfigFileRejectsTrailingData(t *testing.T) {
+	if _, err := readConfigFile(writeConfigFile(t, "config.json", `{"LOANS_PORT": 50051} {}`)); err == nil {
+		t.Errorf("expected an error for a JSON file with more than one object")
+	}
+}
+
+func TestLargeNumbersFromConfigFileCanBeParsed(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.json", `{"NOTIFICATIONS_MAX_CATCH_UP_DAYS": 1000000}`))
+	l := newLoader()
+	if got := l.int("NOTIFICATIONS_MAX_CATCH_UP_DAYS", 7, 0); got != 1000000 {
+		t.Errorf("read %d, want 1000000", got)
+	}
+	if err := l.err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadNotificationsConfigReportsEveryInvalidSetting(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("CASSANDRA_HOSTS", "")
+	t.Setenv("CASSANDRA_KEYSPACE", "library")
+	t.Setenv("KAFKA_BROKERS", "kafka:9092")
+	t.Setenv("NOTIFICATIONS_PORT", "70000")
+	t.Setenv("SHUTDOWN_TIMEOUT", "soon")
+	t.Setenv("LIBRARY_TIME_ZONE", "Europe/Atlantis")
+	t.Setenv("NOTIFICATIONS_LEASE_TTL", "1s")
+	t.Setenv("NOTIFICATIONS_MAX_CATCH_UP_DAYS", "-1")
+	t.Setenv("SIMULATE_TIME", "yes")
+	t.Setenv("TIME_BROADCAST", "carrier-pigeon")
+
+	_, err := LoadNotificationsConfig()
+	if err == nil {
+		t.Fatal("expected an error for invalid settings")
+	}
+	for _, key := range []string{
+		"CASSANDRA_HOSTS",
+		"NOTIFICATIONS_PORT",
+		"SHUTDOWN_TIMEOUT",
+		"LIBRARY_TIME_ZONE",
+		"NOTIFICATIONS_LEASE_TTL",
+		"NOTIFICATIONS_MAX_CATCH_UP_DAYS",
+		"SIMULATE_TIME",
+		"TIME_BROADCAST",
+	} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error doesn't report %s: %v", key, err)
+		}
+	}
+	if strings.Contains(err.Error(), "CASSANDRA_KEYSPACE") || strings.Contains(err.Error(), "KAFKA_BROKERS") {
+		t.Errorf("error reports valid settings: %v", err)
+	}
+}
+
+func TestLoadLoansConfigReadsEnvironmentAndSimulatedTime(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("CASSANDRA_HOSTS", "cassandra-0, cassandra-1")
+	t.Setenv("CASSANDRA_KEYSPACE", "library")
+	t.Setenv("SIMULATE_TIME", "true")
+	t.Setenv("ENV", EnvProduction)
+
+	cfg, err := LoadLoansConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.SimulateTime || cfg.Env != EnvProduction {
+		t.Errorf("SimulateTime = %t, Env = %q; want true, %q", cfg.SimulateTime, cfg.Env, EnvProduction)
+	}
+
+	t.Setenv("SIMULATE_TIME", "")
+	t.Setenv("ENV", "")
+	if cfg, err = LoadLoansConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SimulateTime || cfg.Env == EnvProduction {
+		t.Errorf("SimulateTime = %t, Env = %q; want real time outside production by default", cfg.SimulateTime, cfg.Env)
+	}
+}
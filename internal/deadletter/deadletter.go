@@ -0,0 +1,102 @@
+package deadletter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// TopicSuffix is appended to a topic's name to get the name of its dead letter topic
+const TopicSuffix = ".dlq"
+
+// Headers added to messages published to a dead letter topic
+const (
+	HeaderError             = "dlq-error"
+	HeaderAttempts          = "dlq-attempts"
+	HeaderOriginalTopic     = "dlq-original-topic"
+	HeaderOriginalPartition = "dlq-original-partition"
+	HeaderOriginalOffset    = "dlq-original-offset"
+)
+
+var deadLetterHeaders = map[string]bool{
+	HeaderError:             true,
+	HeaderAttempts:          true,
+	HeaderOriginalTopic:     true,
+	HeaderOriginalPartition: true,
+	HeaderOriginalOffset:    true,
+}
+
+// Topic returns the name of the dead letter topic for a topic
+func Topic(topic string) string {
+	return topic + TopicSuffix
+}
+
+// NewMessage wraps a message that could not be processed for publishing to its topic's dead letter topic, recording
+// why and how many attempts were made
+func NewMessage(msg *sarama.ConsumerMessage, cause error, attempts int) *sarama.ProducerMessage {
+	headers := copyHeaders(msg.Headers)
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderError), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte(HeaderAttempts), Value: []byte(strconv.Itoa(attempts))},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(HeaderOriginalOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	)
+
+	return &sarama.ProducerMessage{
+		Topic:   Topic(msg.Topic),
+		Key:     byteEncoderOrNil(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+}
+
+// NewReplayMessage re-creates the original message from a dead-lettered one
+func NewReplayMessage(msg *sarama.ConsumerMessage) *sarama.ProducerMessage {
+	topic := strings.TrimSuffix(msg.Topic, TopicSuffix)
+	var headers []sarama.RecordHeader
+	for _, h := range copyHeaders(msg.Headers) {
+		if string(h.Key) == HeaderOriginalTopic {
+			topic = string(h.Value)
+		}
+		if !deadLetterHeaders[string(h.Key)] {
+			headers = append(headers, h)
+		}
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     byteEncoderOrNil(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+}
+
+// HeaderValue returns the value of the named header, or the empty string if it isn't present
+func HeaderValue(msg *sarama.ConsumerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func copyHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	copied := make([]sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		if h != nil {
+			copied = append(copied, *h)
+		}
+	}
+	return copied
+}
+
+// byteEncoderOrNil preserves the distinction between a nil key and an empty one
+func byteEncoderOrNil(b []byte) sarama.Encoder {
+	if b == nil {
+		return nil
+	}
+	return sarama.ByteEncoder(b)
+}
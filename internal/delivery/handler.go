@@ -0,0 +1,255 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gocql/gocql"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/deadletter"
+	"github.com/mattgallagher92/library-book-tracker/internal/notifications"
+)
+
+// Request is a decoded send email or send SMS command
+type Request struct {
+	// To is the email address or phone number to send to
+	To         string
+	TemplateID string
+	Locale     string
+	Parameters map[string]string
+	Items      []map[string]string
+	// IdempotencyKey is empty for commands that may be sent more than once
+	IdempotencyKey string
+	// NotificationID and RecipientID are empty for commands that aren't tracked as notifications
+	NotificationID string
+	RecipientID    string
+	// Record is the whole decoded command, for fields that only one channel has
+	Record map[string]interface{}
+}
+
+// Channel renders and sends messages of type M, e.g. emails
+type Channel[M any] interface {
+	// Render returns the message that a request asks for. Requests that can't be rendered are dead-lettered.
+	Render(req Request) (M, error)
+	Send(ctx context.Context, msg M) error
+	// IsPermanent reports whether retrying a failed send can never succeed
+	IsPermanent(err error) bool
+}
+
+// SentStore records which messages have been sent, so that duplicate commands can be skipped
+type SentStore interface {
+	HasBeenSent(ctx context.Context, idempotencyKey string) (bool, error)
+	RecordSent(ctx context.Context, idempotencyKey string, to string) error
+}
+
+// Handler implements sarama.ConsumerGroupHandler for send commands. Each command is sent at most once per idempotency
+// key, retried with exponential backoff, and dead-lettered if it can't be decoded or sending still fails after
+// retrying; once sent, a sent status event is published for the notification it was sent for.
+type Handler[M any] struct {
+	// Name describes the channel in log messages, e.g. "email"
+	Name string
+	// ToField is the command field that holds the recipient, e.g. "toAddress"
+	ToField string
+	// Decode deserializes a command
+	Decode      func(value []byte) (map[string]interface{}, error)
+	Channel     Channel[M]
+	SentStore   SentStore
+	StatusCodec *goavro.Codec
+	// Producer publishes status events and dead-lettered commands
+	Producer sarama.SyncProducer
+	Retry    config.RetryConfig
+}
+
+// DecodeBinary returns a Decode function for commands in Avro's binary encoding, written with codec's schema
+func DecodeBinary(codec *goavro.Codec) func(value []byte) (map[string]interface{}, error) {
+	return func(value []byte) (map[string]interface{}, error) {
+		native, _, err := codec.NativeFromBinary(value)
+		if err != nil {
+			return nil, err
+		}
+		record, ok := native.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected message format")
+		}
+		return record, nil
+	}
+}
+
+// Consume handles commands from topic until ctx is cancelled
+func (h *Handler[M]) Consume(ctx context.Context, group sarama.ConsumerGroup, topic string) {
+	for {
+		err := group.Consume(ctx, []string{topic}, h)
+		if ctx.Err() != nil {
+			// Context was cancelled, time to exit
+			return
+		}
+		if err != nil {
+			log.Printf("Error from consumer: %v", err)
+		}
+	}
+}
+
+func (h *Handler[M]) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
+func (h *Handler[M]) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
+
+func (h *Handler[M]) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		req, msg, err := h.decode(message)
+		if err != nil {
+			// Retrying can't fix a message that can't be decoded or rendered
+			log.Printf("Failed to decode message at offset %d: %v", message.Offset, err)
+			if err := h.deadLetter(message, err, 1); err != nil {
+				return err
+			}
+			session.MarkMessage(message, "")
+			continue
+		}
+
+		if req.IdempotencyKey != "" {
+			sent, err := h.SentStore.HasBeenSent(session.Context(), req.IdempotencyKey)
+			if err != nil {
+				// Leave the message unmarked so that it is redelivered
+				log.Printf("Failed to check whether %s %s has already been sent: %v", h.Name, req.IdempotencyKey, err)
+				return err
+			}
+			if sent {
+				log.Printf("Skipping %s %s to %s because it has already been sent", h.Name, req.IdempotencyKey, req.To)
+				h.publishSent(req)
+				session.MarkMessage(message, "")
+				continue
+			}
+		}
+
+		attempts, err := h.sendWithRetry(session.Context(), req.To, msg)
+		if err != nil {
+			if session.Context().Err() != nil {
+				// Shutting down or rebalancing; leave the message unmarked so that it is redelivered
+				return err
+			}
+			log.Printf("Giving up sending %s to %s after %d attempt(s): %v", h.Name, req.To, attempts, err)
+			if err := h.deadLetter(message, err, attempts); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("Sent %s to %s", h.Name, req.To)
+			if req.IdempotencyKey != "" {
+				if err := h.SentStore.RecordSent(session.Context(), req.IdempotencyKey, req.To); err != nil {
+					// The message has been sent, so retrying would be worse than risking a duplicate later
+					log.Printf("Failed to record that %s %s has been sent: %v", h.Name, req.IdempotencyKey, err)
+				}
+			}
+			h.publishSent(req)
+		}
+
+		// Mark message as processed only once it has been delivered or dead-lettered
+		session.MarkMessage(message, "")
+	}
+	return nil
+}
+
+// decode deserializes a command and renders the message that it asks for
+func (h *Handler[M]) decode(message *sarama.ConsumerMessage) (Request, M, error) {
+	var msg M
+	record, err := h.Decode(message.Value)
+	if err != nil {
+		return Request{}, msg, fmt.Errorf("failed to deserialize message: %w", err)
+	}
+
+	req := Request{Parameters: map[string]string{}, Record: record}
+	req.To, _ = record[h.ToField].(string)
+	req.TemplateID, _ = record["templateId"].(string)
+	req.Locale, _ = record["locale"].(string)
+	req.IdempotencyKey, _ = record["idempotencyKey"].(string)
+	req.NotificationID, _ = record["notificationId"].(string)
+	req.RecipientID, _ = record["recipientId"].(string)
+
+	nativeParams, _ := record["parameters"].(map[string]interface{})
+	for k, v := range nativeParams {
+		req.Parameters[k] = fmt.Sprint(v)
+	}
+
+	nativeItems, _ := record["items"].([]interface{})
+	for _, nativeItem := range nativeItems {
+		item := map[string]string{}
+		nativeItemMap, _ := nativeItem.(map[string]interface{})
+		for k, v := range nativeItemMap {
+			item[k] = fmt.Sprint(v)
+		}
+		req.Items = append(req.Items, item)
+	}
+
+	msg, err = h.Channel.Render(req)
+	if err != nil {
+		return Request{}, msg, err
+	}
+	return req, msg, nil
+}
+
+// publishSent tells the borrower notification service that the notification the command was sent for has been sent
+func (h *Handler[M]) publishSent(req Request) {
+	if req.NotificationID == "" {
+		return
+	}
+
+	notificationID, err := gocql.ParseUUID(req.NotificationID)
+	if err != nil {
+		log.Printf("Invalid notification ID %q: %v", req.NotificationID, err)
+		return
+	}
+	recipientID, err := gocql.ParseUUID(req.RecipientID)
+	if err != nil {
+		log.Printf("Invalid recipient ID %q: %v", req.RecipientID, err)
+		return
+	}
+
+	event, err := notifications.NewStatusChangedMessage(h.StatusCodec, notifications.StatusChanged{
+		NotificationID: notificationID,
+		RecipientID:    recipientID,
+		Status:         notifications.StatusSent,
+		ChangedAt:      time.Now(),
+	})
+	if err == nil {
+		_, _, err = h.Producer.SendMessage(event)
+	}
+	if err != nil {
+		// The message has been sent, so this only affects the notification's status shown to staff
+		log.Printf("Failed to publish sent status of notification %s: %v", req.NotificationID, err)
+	}
+}
+
+// sendWithRetry tries to send the message, backing off exponentially between attempts that fail with transient
+// errors. It returns the number of attempts made.
+func (h *Handler[M]) sendWithRetry(ctx context.Context, to string, msg M) (int, error) {
+	backoff := h.Retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		log.Printf("Sending %s to %s (attempt %d)", h.Name, to, attempt)
+		err := h.Channel.Send(ctx, msg)
+		if err == nil {
+			return attempt, nil
+		}
+		if h.Channel.IsPermanent(err) || attempt >= h.Retry.MaxAttempts {
+			return attempt, err
+		}
+
+		log.Printf("Failed to send %s to %s, retrying in %s: %v", h.Name, to, backoff, err)
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, h.Retry.MaxBackoff)
+	}
+}
+
+func (h *Handler[M]) deadLetter(message *sarama.ConsumerMessage, cause error, attempts int) error {
+	if _, _, err := h.Producer.SendMessage(deadletter.NewMessage(message, cause, attempts)); err != nil {
+		log.Printf("Failed to publish message at offset %d to %s: %v", message.Offset, deadletter.Topic(message.Topic), err)
+		return err
+	}
+	log.Printf("Published message at offset %d to %s", message.Offset, deadletter.Topic(message.Topic))
+	return nil
+}
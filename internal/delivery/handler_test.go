@@ -0,0 +1,212 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/deadletter"
+)
+
+// events records calls to the fakes in order
+type events []string
+
+var (
+	errTemporary = errors.New("temporary failure")
+	errPermanent = errors.New("permanent failure")
+)
+
+// fakeChannel sends messages that are just the recipient, failing with each of errs in turn before succeeding
+type fakeChannel struct {
+	events *events
+	errs   []error
+	sent   []string
+}
+
+func (c *fakeChannel) Render(req Request) (string, error) { return req.To, nil }
+
+func (c *fakeChannel) Send(_ context.Context, msg string) error {
+	*c.events = append(*c.events, "send "+msg)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *fakeChannel) IsPermanent(err error) bool { return errors.Is(err, errPermanent) }
+
+// memorySentStore is a SentStore that keeps idempotency keys in memory
+type memorySentStore struct {
+	events *events
+	sent   map[string]string
+}
+
+func (s *memorySentStore) HasBeenSent(_ context.Context, idempotencyKey string) (bool, error) {
+	_, ok := s.sent[idempotencyKey]
+	return ok, nil
+}
+
+func (s *memorySentStore) RecordSent(_ context.Context, idempotencyKey string, to string) error {
+	*s.events = append(*s.events, "record "+idempotencyKey)
+	s.sent[idempotencyKey] = to
+	return nil
+}
+
+// fakeProducer records the messages published with SendMessage. Other methods aren't used by Handler.
+type fakeProducer struct {
+	sarama.SyncProducer
+	messages []*sarama.ProducerMessage
+}
+
+func (p *fakeProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.messages = append(p.messages, msg)
+	return 0, int64(len(p.messages)), nil
+}
+
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *fakeSession) Context() context.Context { return context.Background() }
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+type handlerTest struct {
+	events   events
+	channel  *fakeChannel
+	store    *memorySentStore
+	producer *fakeProducer
+	session  *fakeSession
+	handler  *Handler[string]
+}
+
+// newHandlerTest returns a handler whose channel fails with each of errs before succeeding
+func newHandlerTest(errs ...error) *handlerTest {
+	ht := &handlerTest{producer: &fakeProducer{}, session: &fakeSession{}}
+	ht.channel = &fakeChannel{events: &ht.events, errs: errs}
+	ht.store = &memorySentStore{events: &ht.events, sent: map[string]string{}}
+	ht.handler = &Handler[string]{
+		Name:    "test",
+		ToField: "to",
+		Decode: func(value []byte) (map[string]interface{}, error) {
+			return map[string]interface{}{"to": "reader@example.com", "idempotencyKey": string(value)}, nil
+		},
+		Channel:   ht.channel,
+		SentStore: ht.store,
+		Producer:  ht.producer,
+		Retry:     config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+	}
+	return ht
+}
+
+// consume handles a command with idempotencyKey as its idempotency key
+func (ht *handlerTest) consume(t *testing.T, idempotencyKey string) {
+	t.Helper()
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "commands", Offset: 42, Value: []byte(idempotencyKey)}
+	close(claim.messages)
+	if err := ht.handler.ConsumeClaim(ht.session, claim); err != nil {
+		t.Fatalf("ConsumeClaim failed: %v", err)
+	}
+	if !slices.Equal(ht.session.marked, []int64{42}) {
+		t.Errorf("marked offsets %v, want [42]", ht.session.marked)
+	}
+}
+
+// deadLettered returns the dead-lettered messages' attempts headers
+func (ht *handlerTest) deadLettered() []string {
+	var attempts []string
+	for _, msg := range ht.producer.messages {
+		if msg.Topic != deadletter.Topic("commands") {
+			continue
+		}
+		for _, h := range msg.Headers {
+			if string(h.Key) == deadletter.HeaderAttempts {
+				attempts = append(attempts, string(h.Value))
+			}
+		}
+	}
+	return attempts
+}
+
+func TestHandlerRetriesTemporaryFailures(t *testing.T) {
+	ht := newHandlerTest(errTemporary, errTemporary)
+	ht.consume(t, "key-1")
+
+	if len(ht.channel.sent) != 1 {
+		t.Errorf("sent %d message(s), want 1", len(ht.channel.sent))
+	}
+	if attempts := ht.deadLettered(); len(attempts) != 0 {
+		t.Errorf("dead-lettered a message that was sent")
+	}
+	if ht.store.sent["key-1"] != "reader@example.com" {
+		t.Errorf("didn't record that the message was sent")
+	}
+}
+
+func TestHandlerDeadLettersWhenRetriesRunOut(t *testing.T) {
+	ht := newHandlerTest(errTemporary, errTemporary, errTemporary)
+	ht.consume(t, "key-1")
+
+	if len(ht.events) != 3 {
+		t.Errorf("events %v, want 3 attempts to send", ht.events)
+	}
+	if attempts := ht.deadLettered(); !slices.Equal(attempts, []string{"3"}) {
+		t.Errorf("dead-lettered with attempts %v, want [3]", attempts)
+	}
+	if _, ok := ht.store.sent["key-1"]; ok {
+		t.Errorf("recorded a message that wasn't sent as sent")
+	}
+}
+
+func TestHandlerDeadLettersPermanentFailuresWithoutRetrying(t *testing.T) {
+	ht := newHandlerTest(errPermanent)
+	ht.consume(t, "key-1")
+
+	if !slices.Equal(ht.events, events{"send reader@example.com"}) {
+		t.Errorf("events %v, want a single attempt to send", ht.events)
+	}
+	if attempts := ht.deadLettered(); !slices.Equal(attempts, []string{"1"}) {
+		t.Errorf("dead-lettered with attempts %v, want [1]", attempts)
+	}
+}
+
+func TestHandlerSkipsMessagesAlreadySent(t *testing.T) {
+	ht := newHandlerTest()
+	ht.store.sent["key-1"] = "reader@example.com"
+	ht.consume(t, "key-1")
+
+	if len(ht.events) != 0 {
+		t.Errorf("events %v, want none for a message already sent", ht.events)
+	}
+	if len(ht.producer.messages) != 0 {
+		t.Errorf("published %d message(s), want none", len(ht.producer.messages))
+	}
+}
+
+func TestHandlerRecordsSentOnlyAfterSending(t *testing.T) {
+	ht := newHandlerTest(errTemporary)
+	ht.consume(t, "key-1")
+
+	want := events{"send reader@example.com", "send reader@example.com", "record key-1"}
+	if !slices.Equal(ht.events, want) {
+		t.Errorf("events %v, want %v", ht.events, want)
+	}
+}
@@ -0,0 +1,91 @@
+package email
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// CommandSchemaPath is where services find the Avro schema for send email commands
+const CommandSchemaPath = "schemas/avro/commands/send_email.avsc"
+
+// legacyCommandSchemaPaths are the schemas of commands published before commands were tagged with their schema's
+// fingerprint, newest first. Commands written with them may still be in flight or in the dead letter topic.
+var legacyCommandSchemaPaths = []string{
+	// Plain text emails with an idempotency key
+	"schemas/avro/commands/legacy/send_email.v2.avsc",
+	// Plain text emails with a subject and body
+	"schemas/avro/commands/legacy/send_email.v1.avsc",
+}
+
+// CommandCodec encodes send email commands in Avro's single object encoding, which starts with the fingerprint of
+// the schema that wrote it, and decodes both those and untagged commands written with a legacy schema
+type CommandCodec struct {
+	current *goavro.Codec
+	legacy  []*goavro.Codec
+}
+
+// LoadCommandCodec reads the current and legacy schemas for send email commands
+func LoadCommandCodec() (*CommandCodec, error) {
+	current, err := loadCodec(CommandSchemaPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &CommandCodec{current: current}
+	for _, path := range legacyCommandSchemaPaths {
+		codec, err := loadCodec(path)
+		if err != nil {
+			return nil, err
+		}
+		c.legacy = append(c.legacy, codec)
+	}
+	return c, nil
+}
+
+func loadCodec(path string) (*goavro.Codec, error) {
+	schemaFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := goavro.NewCodec(string(schemaFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Avro schema %s: %w", path, err)
+	}
+	return codec, nil
+}
+
+// Encode serializes a command with the current schema
+func (c *CommandCodec) Encode(native map[string]interface{}) ([]byte, error) {
+	return c.current.SingleFromNative(nil, native)
+}
+
+// Decode deserializes a command written with the current schema or, if it isn't tagged with a fingerprint, the
+// newest legacy schema that it is a complete record of
+func (c *CommandCodec) Decode(value []byte) (map[string]interface{}, error) {
+	// Single object encoding starts with 0xC3 0x01, which can't start an untagged command because it would be a
+	// negative string length
+	if len(value) >= 2 && value[0] == 0xC3 && value[1] == 0x01 {
+		native, _, err := c.current.NativeFromSingle(value)
+		if err != nil {
+			return nil, err
+		}
+		return asRecord(native)
+	}
+
+	for _, codec := range c.legacy {
+		native, rest, err := codec.NativeFromBinary(value)
+		if err == nil && len(rest) == 0 {
+			return asRecord(native)
+		}
+	}
+	return nil, fmt.Errorf("message doesn't match the current or any legacy send email command schema")
+}
+
+func asRecord(native interface{}) (map[string]interface{}, error) {
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected message format")
+	}
+	return record, nil
+}
@@ -0,0 +1,134 @@
+package email
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// inRepoRoot runs the rest of the test from the root of the repository, which schema paths are relative to
+func inRepoRoot(t *testing.T) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func loadCommandCodec(t *testing.T) *CommandCodec {
+	t.Helper()
+	inRepoRoot(t)
+	codec, err := LoadCommandCodec()
+	if err != nil {
+		t.Fatalf("failed to load command codec: %v", err)
+	}
+	return codec
+}
+
+func TestCommandCodecDecodesCurrentCommands(t *testing.T) {
+	codec := loadCommandCodec(t)
+
+	value, err := codec.Encode(map[string]interface{}{
+		"toAddress":      "reader@example.com",
+		"templateId":     TemplateDueSoon,
+		"locale":         "cy",
+		"parameters":     map[string]interface{}{"bookTitle": "Middlemarch"},
+		"idempotencyKey": "due-soon:1",
+	})
+	if err != nil {
+		t.Fatalf("failed to encode command: %v", err)
+	}
+
+	record, err := codec.Decode(value)
+	if err != nil {
+		t.Fatalf("failed to decode command: %v", err)
+	}
+	want := map[string]interface{}{
+		"toAddress":      "reader@example.com",
+		"templateId":     TemplateDueSoon,
+		"locale":         "cy",
+		"parameters":     map[string]interface{}{"bookTitle": "Middlemarch"},
+		"items":          []interface{}{},
+		"idempotencyKey": "due-soon:1",
+		"notificationId": "",
+		"recipientId":    "",
+		"subject":        nil,
+		"body":           nil,
+	}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("decoded %v, want %v", record, want)
+	}
+}
+
+func TestCommandCodecDecodesLegacyCommands(t *testing.T) {
+	codec := loadCommandCodec(t)
+
+	tests := []struct {
+		schema string
+		native map[string]interface{}
+	}{
+		{
+			"schemas/avro/commands/legacy/send_email.v1.avsc",
+			map[string]interface{}{
+				"toAddress": "reader@example.com",
+				"subject":   "Library Book Due Soon: Middlemarch",
+				"body":      "This is a reminder that 'Middlemarch' is due soon.",
+			},
+		},
+		{
+			"schemas/avro/commands/legacy/send_email.v2.avsc",
+			map[string]interface{}{
+				"toAddress":      "reader@example.com",
+				"subject":        "Library Book Due Soon: Middlemarch",
+				"body":           "This is a reminder that 'Middlemarch' is due soon.",
+				"idempotencyKey": "due-soon:1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			legacy, err := loadCodec(tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := legacy.BinaryFromNative(nil, tt.native)
+			if err != nil {
+				t.Fatalf("failed to encode command: %v", err)
+			}
+
+			record, err := codec.Decode(value)
+			if err != nil {
+				t.Fatalf("failed to decode command: %v", err)
+			}
+			if !reflect.DeepEqual(record, tt.native) {
+				t.Errorf("decoded %v, want %v", record, tt.native)
+			}
+		})
+	}
+}
+
+func TestCommandCodecRejectsUnknownMessages(t *testing.T) {
+	codec := loadCommandCodec(t)
+
+	tests := map[string][]byte{
+		"empty": {},
+		// A string can't have a negative length
+		"untagged garbage":    {0x01, 0x02, 0x03},
+		"unknown fingerprint": {0xC3, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, 0x02, 'a'},
+	}
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			if record, err := codec.Decode(value); err == nil {
+				t.Errorf("decoded %v, want an error", record)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Message is an email ready to be delivered. If HTMLBody is set, it is sent as an alternative to TextBody.
+type Message struct {
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+// Sender delivers emails. Send must only return nil once delivery has been confirmed.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// ErrInvalidAddress means a message's recipient isn't a valid email address, so it can never be sent
+var ErrInvalidAddress = errors.New("invalid email address")
+
+// smtpTimeout bounds a whole SMTP session when ctx has no deadline, so that a hung server can't block sending forever
+const smtpTimeout = time.Minute
+
+// SMTPSender delivers emails through an SMTP server
+type SMTPSender struct {
+	Host     string
+	Port     int
+	From     string
+	StartTLS bool
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.From, msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %w", addr, err)
+	}
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if s.StartTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if s.Username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted connection unless the server is localhost
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.From); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("failed to set recipient: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start message data: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write message data: %w", err)
+	}
+	// The server only accepts the message once the data writer is closed
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message not accepted by SMTP server: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// MaildirSender captures emails as files in a maildir instead of delivering them, for development and tests
+type MaildirSender struct {
+	Dir  string
+	From string
+}
+
+func (s *MaildirSender) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.From, msg)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(s.Dir, sub), 0o755); err != nil {
+			return fmt.Errorf("failed to create maildir: %w", err)
+		}
+	}
+
+	name, err := uniqueName()
+	if err != nil {
+		return err
+	}
+
+	// Write to tmp then rename into new so that readers never see a partially written message
+	tmpPath := filepath.Join(s.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.Dir, "new", name)); err != nil {
+		return fmt.Errorf("failed to deliver message to maildir: %w", err)
+	}
+
+	return nil
+}
+
+func uniqueName() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate message name: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(random), hostname), nil
+}
+
+// format renders the message in RFC 5322 format. The recipient is parsed rather than copied into the headers, so
+// that an address containing a line break can't add headers of its own.
+func format(from string, msg Message) ([]byte, error) {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", ErrInvalidAddress, msg.To, err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTMLBody == "" {
+		b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&b, msg.TextBody)
+		return b.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	// Clients display the last alternative that they support, so the plain text part must come first
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", msg.TextBody},
+		{"text/html; charset=UTF-8", msg.HTMLBody},
+	} {
+		// Writing to a bytes.Buffer can't fail, so neither can creating parts
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, part.body)
+	}
+	mw.Close()
+
+	return b.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+// IsPermanent reports whether retrying a failed send can never succeed, for example because the SMTP server
+// rejected the recipient address
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrInvalidAddress) {
+		return true
+	}
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
@@ -0,0 +1,34 @@
+package email
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraSentStore is a delivery.SentStore backed by the sent_emails table
+type CassandraSentStore struct {
+	Session *gocql.Session
+}
+
+func (s *CassandraSentStore) HasBeenSent(ctx context.Context, idempotencyKey string) (bool, error) {
+	var sentAt time.Time
+	if err := s.Session.Query(
+		`SELECT sent_at FROM sent_emails WHERE idempotency_key = ?`,
+		idempotencyKey,
+	).WithContext(ctx).Idempotent(true).Scan(&sentAt); err != nil {
+		if err == gocql.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *CassandraSentStore) RecordSent(ctx context.Context, idempotencyKey string, toAddress string) error {
+	return s.Session.Query(
+		`INSERT INTO sent_emails (idempotency_key, to_address, sent_at) VALUES (?, ?, ?)`,
+		idempotencyKey, toAddress, time.Now(),
+	).WithContext(ctx).Idempotent(true).Exec()
+}
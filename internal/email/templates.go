@@ -0,0 +1,110 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+)
+
+// IDs of the templates that can be referenced by send email commands
+const (
+	TemplateDueSoon          = "due-soon"
+	TemplateDueSoonDigest    = "due-soon-digest"
+	TemplateOverdue          = "overdue"
+	TemplateHoldReady        = "hold-ready"
+	TemplateInterestReturned = "interest-returned"
+)
+
+var templateIDs = []string{TemplateDueSoon, TemplateDueSoonDigest, TemplateOverdue, TemplateHoldReady, TemplateInterestReturned}
+
+// Templates renders emails from the template files in a directory. Each template ID has three files:
+// <id>.subject.tmpl and <id>.txt.tmpl (text/template) and <id>.html.tmpl (html/template). Templates can use the
+// localisation functions described by i18n.Catalogs.Funcs.
+type Templates struct {
+	text     *texttemplate.Template
+	html     *htmltemplate.Template
+	catalogs *i18n.Catalogs
+}
+
+// LoadTemplates parses the template files in dir, failing if any template is missing
+func LoadTemplates(dir string, catalogs *i18n.Catalogs) (*Templates, error) {
+	text, err := texttemplate.New("").Option("missingkey=error").Funcs(i18n.PlaceholderFuncs).ParseGlob(filepath.Join(dir, "*.txt.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text templates: %w", err)
+	}
+	if text, err = text.ParseGlob(filepath.Join(dir, "*.subject.tmpl")); err != nil {
+		return nil, fmt.Errorf("failed to parse subject templates: %w", err)
+	}
+
+	html, err := htmltemplate.New("").Option("missingkey=error").Funcs(i18n.PlaceholderFuncs).ParseGlob(filepath.Join(dir, "*.html.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML templates: %w", err)
+	}
+
+	for _, id := range templateIDs {
+		for _, name := range []string{id + ".subject.tmpl", id + ".txt.tmpl"} {
+			if text.Lookup(name) == nil {
+				return nil, fmt.Errorf("template %s not found in %s", name, dir)
+			}
+		}
+		if html.Lookup(id+".html.tmpl") == nil {
+			return nil, fmt.Errorf("template %s.html.tmpl not found in %s", id, dir)
+		}
+	}
+
+	return &Templates{text: text, html: html, catalogs: catalogs}, nil
+}
+
+// Render creates the email to send to toAddress in the given locale using the named template. Templates can refer to
+// params by name and range over items as .items.
+func (t *Templates) Render(templateID string, locale string, toAddress string, params map[string]string, items []map[string]string) (Message, error) {
+	if t.text.Lookup(templateID+".subject.tmpl") == nil {
+		return Message{}, fmt.Errorf("unknown template %q", templateID)
+	}
+
+	funcs := t.catalogs.Funcs(locale)
+	textTemplates, err := t.text.Clone()
+	if err != nil {
+		return Message{}, err
+	}
+	textTemplates.Funcs(funcs)
+	htmlTemplates, err := t.html.Clone()
+	if err != nil {
+		return Message{}, err
+	}
+	htmlTemplates.Funcs(funcs)
+
+	data := templateData(params, items)
+	var subject, text, html bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&subject, templateID+".subject.tmpl", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render subject: %w", err)
+	}
+	if err := textTemplates.ExecuteTemplate(&text, templateID+".txt.tmpl", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render text body: %w", err)
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, templateID+".html.tmpl", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render HTML body: %w", err)
+	}
+
+	return Message{
+		To:       toAddress,
+		Subject:  strings.TrimSpace(subject.String()),
+		TextBody: text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
+
+// templateData combines a command's parameters and items into the value that templates are executed with
+func templateData(params map[string]string, items []map[string]string) map[string]any {
+	data := make(map[string]any, len(params)+1)
+	for k, v := range params {
+		data[k] = v
+	}
+	data["items"] = items
+	return data
+}
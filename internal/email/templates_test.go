@@ -0,0 +1,120 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+)
+
+func loadTemplates(t *testing.T) *Templates {
+	t.Helper()
+	catalogs, err := i18n.LoadCatalogs("../../templates/locales")
+	if err != nil {
+		t.Fatalf("failed to load catalogs: %v", err)
+	}
+	templates, err := LoadTemplates("../../templates/email", catalogs)
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+	return templates
+}
+
+// testParams has every parameter that any template uses
+var testParams = map[string]string{
+	"borrowerName": "Dorothea",
+	"bookTitle":    "Middlemarch",
+	"bookAuthor":   "George Eliot",
+	"dueDate":      "2025-03-08",
+	"collectBy":    "2025-03-08",
+}
+
+var testItems = []map[string]string{
+	{"bookTitle": "Middlemarch", "bookAuthor": "George Eliot", "dueDate": "2025-03-08"},
+	{"bookTitle": "Silas Marner", "bookAuthor": "George Eliot", "dueDate": "2025-03-08"},
+}
+
+func TestRenderEveryTemplateInEveryLocale(t *testing.T) {
+	templates := loadTemplates(t)
+
+	locales := []struct {
+		locale   string
+		greeting string
+		date     string
+	}{
+		{"en", "Dear Dorothea,", "8 March 2025"},
+		{"cy", "Annwyl Dorothea,", "8 Mawrth 2025"},
+	}
+	for _, l := range locales {
+		for _, id := range templateIDs {
+			t.Run(l.locale+"/"+id, func(t *testing.T) {
+				msg, err := templates.Render(id, l.locale, "reader@example.com", testParams, testItems)
+				if err != nil {
+					t.Fatalf("failed to render: %v", err)
+				}
+				if msg.To != "reader@example.com" || msg.Subject == "" {
+					t.Errorf("To = %q, Subject = %q; want the recipient and a subject", msg.To, msg.Subject)
+				}
+				// Digests are about several books, so their subject gives the number of books instead
+				wantInSubject := "Middlemarch"
+				if id == TemplateDueSoonDigest {
+					wantInSubject = "2"
+				}
+				if !strings.Contains(msg.Subject, wantInSubject) {
+					t.Errorf("Subject %q doesn't contain %q", msg.Subject, wantInSubject)
+				}
+				for name, body := range map[string]string{"text": msg.TextBody, "HTML": msg.HTMLBody} {
+					if !strings.Contains(body, l.greeting) || !strings.Contains(body, "Middlemarch") {
+						t.Errorf("%s body doesn't greet the borrower in %s or name the book:\n%s", name, l.locale, body)
+					}
+					if id != TemplateInterestReturned && !strings.Contains(body, l.date) {
+						t.Errorf("%s body doesn't have the date formatted for %s:\n%s", name, l.locale, body)
+					}
+				}
+				if !strings.Contains(msg.HTMLBody, `lang="`+l.locale+`"`) {
+					t.Errorf("HTML body isn't marked as %s", l.locale)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderFallsBackToDefaultLocale(t *testing.T) {
+	msg, err := loadTemplates(t).Render(TemplateDueSoon, "fr", "reader@example.com", testParams, nil)
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+	if !strings.Contains(msg.TextBody, "Dear Dorothea,") || !strings.Contains(msg.HTMLBody, `lang="en"`) {
+		t.Errorf("email wasn't rendered in %s:\n%s", i18n.DefaultLocale, msg.TextBody)
+	}
+}
+
+func TestRenderEscapesParametersInHTML(t *testing.T) {
+	params := map[string]string{}
+	for k, v := range testParams {
+		params[k] = v
+	}
+	params["borrowerName"] = "Tom & Jerry"
+	params["bookTitle"] = `<script>alert("hi")</script>`
+
+	msg, err := loadTemplates(t).Render(TemplateDueSoon, "en", "reader@example.com", params, nil)
+	if err != nil {
+		t.Fatalf("failed to render: %v", err)
+	}
+	if strings.Contains(msg.HTMLBody, "<script>") || !strings.Contains(msg.HTMLBody, "&lt;script&gt;") {
+		t.Errorf("book title wasn't escaped in HTML body:\n%s", msg.HTMLBody)
+	}
+	if !strings.Contains(msg.HTMLBody, "Tom &amp; Jerry") {
+		t.Errorf("borrower name wasn't escaped in HTML body:\n%s", msg.HTMLBody)
+	}
+	// Plain text isn't HTML, so it is left as written
+	if !strings.Contains(msg.TextBody, `<script>alert("hi")</script>`) || !strings.Contains(msg.Subject, "<script>") {
+		t.Errorf("book title was escaped in text body or subject:\n%s\n%s", msg.Subject, msg.TextBody)
+	}
+}
+
+func TestRenderRejectsUnknownTemplate(t *testing.T) {
+	if _, err := loadTemplates(t).Render("welcome", "en", "reader@example.com", testParams, nil); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+}
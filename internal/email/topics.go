@@ -0,0 +1,4 @@
+package email
+
+// CommandTopic is the topic that send email commands are published to
+const CommandTopic = "send-email-command"
@@ -0,0 +1,127 @@
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLocale is used for borrowers without a preferred language and for keys missing from other catalogs
+const DefaultLocale = "en"
+
+// Catalogs contains the translated messages for each locale, loaded from <locale>.json files
+type Catalogs struct {
+	messages map[string]map[string]string
+}
+
+// LoadCatalogs reads the message catalogs in dir, failing if there isn't one for the default locale
+func LoadCatalogs(dir string) (*Catalogs, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Catalogs{messages: map[string]map[string]string{}}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message catalog: %w", err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("failed to parse message catalog %s: %w", path, err)
+		}
+		c.messages[strings.TrimSuffix(filepath.Base(path), ".json")] = messages
+	}
+
+	if _, ok := c.messages[DefaultLocale]; !ok {
+		return nil, fmt.Errorf("no message catalog for default locale %q in %s", DefaultLocale, dir)
+	}
+
+	return c, nil
+}
+
+// Locales returns the locales that have a catalog, in alphabetical order
+func (c *Catalogs) Locales() []string {
+	locales := make([]string, 0, len(c.messages))
+	for locale := range c.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// MissingKeys returns the keys in the default catalog that the locale's catalog doesn't translate
+func (c *Catalogs) MissingKeys(locale string) []string {
+	var missing []string
+	for key := range c.messages[DefaultLocale] {
+		if _, ok := c.messages[locale][key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// HasLocale reports whether there is a catalog for the locale
+func (c *Catalogs) HasLocale(locale string) bool {
+	_, ok := c.messages[locale]
+	return ok
+}
+
+// Translate formats the message with the given key in the locale, falling back to the default locale if the key
+// hasn't been translated
+func (c *Catalogs) Translate(locale, key string, args ...any) (string, error) {
+	message, ok := c.messages[locale][key]
+	if !ok {
+		if message, ok = c.messages[DefaultLocale][key]; !ok {
+			return "", fmt.Errorf("message %q not found", key)
+		}
+	}
+	if len(args) == 0 {
+		return message, nil
+	}
+	return fmt.Sprintf(message, args...), nil
+}
+
+// FormatDate formats an ISO 8601 date (e.g. 2025-02-08) for the locale
+func (c *Catalogs) FormatDate(locale, isoDate string) (string, error) {
+	date, err := time.Parse(time.DateOnly, isoDate)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q: %w", isoDate, err)
+	}
+	month, err := c.Translate(locale, "date.month."+strconv.Itoa(int(date.Month())))
+	if err != nil {
+		return "", err
+	}
+	return c.Translate(locale, "date.format", date.Day(), month, date.Year())
+}
+
+// PlaceholderFuncs allow templates that use the functions returned by Funcs to be parsed before the locale is known
+var PlaceholderFuncs = map[string]any{
+	"t":      func(key string, args ...any) (string, error) { return "", nil },
+	"date":   func(isoDate string) (string, error) { return "", nil },
+	"locale": func() string { return "" },
+}
+
+// Funcs returns template functions for the locale: {{t "key" args...}} translates a message, {{date .isoDate}}
+// formats a date and {{locale}} returns the locale, which is the default locale if there's no catalog for it
+func (c *Catalogs) Funcs(locale string) map[string]any {
+	if !c.HasLocale(locale) {
+		locale = DefaultLocale
+	}
+	return map[string]any{
+		"t": func(key string, args ...any) (string, error) {
+			return c.Translate(locale, key, args...)
+		},
+		"date": func(isoDate string) (string, error) {
+			return c.FormatDate(locale, isoDate)
+		},
+		"locale": func() string { return locale },
+	}
+}
@@ -0,0 +1,125 @@
+package i18n
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"text/template/parse"
+)
+
+const templatesDir = "../../templates"
+
+// TestCatalogsTranslateTemplateKeys checks that every message that the email and SMS templates use is in every locale's
+// catalog, so that no borrower gets a message in the default locale because a translation was forgotten
+func TestCatalogsTranslateTemplateKeys(t *testing.T) {
+	catalogs, err := LoadCatalogs(filepath.Join(templatesDir, "locales"))
+	if err != nil {
+		t.Fatalf("failed to load catalogs: %v", err)
+	}
+
+	keys := map[string]bool{}
+	for _, pattern := range []string{"email/*.tmpl", "sms/*.tmpl"} {
+		paths, err := filepath.Glob(filepath.Join(templatesDir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			for _, key := range templateKeys(t, path) {
+				keys[key] = true
+			}
+		}
+	}
+	if len(keys) == 0 {
+		t.Fatalf("no messages found in the templates in %s", templatesDir)
+	}
+
+	for _, locale := range catalogs.Locales() {
+		for key := range keys {
+			if _, ok := catalogs.messages[locale][key]; !ok {
+				t.Errorf("catalog %s.json is missing %q", locale, key)
+			}
+		}
+		if missing := catalogs.MissingKeys(locale); len(missing) > 0 {
+			t.Errorf("catalog %s.json is missing %v, which are in %s.json", locale, missing, DefaultLocale)
+		}
+	}
+}
+
+// templateKeys returns the keys of the messages that a template file uses, directly with t or indirectly with date
+func templateKeys(t *testing.T, path string) []string {
+	t.Helper()
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Function calls are checked when the templates are loaded, so the built in functions needn't be declared here
+	tree := parse.New(filepath.Base(path))
+	tree.Mode = parse.SkipFuncCheck
+	trees := map[string]*parse.Tree{}
+	if _, err := tree.Parse(string(text), "", "", trees); err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+
+	var keys []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			if len(n.Args) > 0 {
+				if ident, ok := n.Args[0].(*parse.IdentifierNode); ok {
+					switch ident.Ident {
+					case "t":
+						if len(n.Args) < 2 {
+							t.Errorf("%s: t is called without a key", path)
+						} else if key, ok := n.Args[1].(*parse.StringNode); ok {
+							keys = append(keys, key.Text)
+						} else {
+							t.Errorf("%s: t is called with a key that isn't a string literal, so can't be checked", path)
+						}
+					case "date":
+						keys = append(keys, "date.format")
+						for month := 1; month <= 12; month++ {
+							keys = append(keys, "date.month."+strconv.Itoa(month))
+						}
+					}
+				}
+			}
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	for _, tree := range trees {
+		walk(tree.Root)
+	}
+	return keys
+}
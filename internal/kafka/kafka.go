@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/IBM/sarama"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+)
+
+// NewConfig returns a sarama config with the connection settings shared by every producer and consumer: client ID,
+// SASL and TLS
+func NewConfig(cfg config.KafkaConfig) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+	c.ClientID = cfg.KafkaClientID
+
+	if cfg.KafkaSASLMechanism != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.User = cfg.KafkaSASLUsername
+		c.Net.SASL.Password = cfg.KafkaSASLPassword
+		switch cfg.KafkaSASLMechanism {
+		case config.KafkaSASLPlain:
+			c.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case config.KafkaSASLSCRAMSHA256:
+			c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return newSCRAMSHA256Client() }
+		case config.KafkaSASLSCRAMSHA512:
+			c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return newSCRAMSHA512Client() }
+		default:
+			return nil, fmt.Errorf("unsupported SASL mechanism %q", cfg.KafkaSASLMechanism)
+		}
+	}
+
+	if cfg.KafkaTLS {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsConfig
+	}
+
+	return c, nil
+}
+
+// ProducerConfig returns a config for producers that wait for every in-sync replica to acknowledge each message
+func ProducerConfig(cfg config.KafkaConfig) (*sarama.Config, error) {
+	c, err := NewConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Producer.Return.Successes = true
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Retry.Max = 5
+
+	switch cfg.KafkaCompression {
+	case "", "none":
+		c.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		c.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		c.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		c.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		c.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", cfg.KafkaCompression)
+	}
+
+	// Idempotence relies on the broker seeing each producer's requests in order
+	if cfg.KafkaIdempotentProducer {
+		c.Producer.Idempotent = true
+		c.Net.MaxOpenRequests = 1
+	}
+
+	return c, nil
+}
+
+// ConsumerGroupConfig returns a config for consumer groups, which start from initialOffset (sarama.OffsetOldest or
+// sarama.OffsetNewest) when the group has no committed offset
+func ConsumerGroupConfig(cfg config.KafkaConfig, initialOffset int64) (*sarama.Config, error) {
+	c, err := NewConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Consumer.Offsets.Initial = initialOffset
+	c.Consumer.Group.Session.Timeout = cfg.KafkaSessionTimeout
+	c.Consumer.Group.Heartbeat.Interval = cfg.KafkaHeartbeatInterval
+
+	switch cfg.KafkaRebalanceStrategy {
+	case "", "roundrobin":
+		c.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRoundRobin()}
+	case "range":
+		c.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
+	case "sticky":
+		c.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategySticky()}
+	default:
+		return nil, fmt.Errorf("unsupported rebalance strategy %q", cfg.KafkaRebalanceStrategy)
+	}
+
+	return c, nil
+}
+
+func NewSyncProducer(cfg config.KafkaConfig) (sarama.SyncProducer, error) {
+	c, err := ProducerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewSyncProducer(cfg.KafkaBrokers, c)
+}
+
+func NewConsumerGroup(cfg config.KafkaConfig, groupID string, initialOffset int64) (sarama.ConsumerGroup, error) {
+	c, err := ConsumerGroupConfig(cfg, initialOffset)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewConsumerGroup(cfg.KafkaBrokers, groupID, c)
+}
+
+// NewClient returns a client with just the shared connection settings, e.g. for reading partitions directly. Partition
+// consumers created from it report errors on their Errors channels, which are otherwise only logged.
+func NewClient(cfg config.KafkaConfig) (sarama.Client, error) {
+	c, err := NewConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Consumer.Return.Errors = true
+	return sarama.NewClient(cfg.KafkaBrokers, c)
+}
+
+func newTLSConfig(cfg config.KafkaConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.KafkaTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.KafkaTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Kafka CA file %s", cfg.KafkaTLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.KafkaTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.KafkaTLSCertFile, cfg.KafkaTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,319 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/xdg-go/scram"
+)
+
+func testConfig() config.KafkaConfig {
+	return config.KafkaConfig{
+		KafkaBrokers:           []string{"localhost:9092"},
+		KafkaClientID:          "test",
+		KafkaSessionTimeout:    10 * time.Second,
+		KafkaHeartbeatInterval: 3 * time.Second,
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir, returning their paths
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestNewConfigWithoutSASLOrTLS(t *testing.T) {
+	c, err := NewConfig(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ClientID != "test" {
+		t.Errorf("ClientID = %q, want %q", c.ClientID, "test")
+	}
+	if c.Net.SASL.Enable || c.Net.TLS.Enable {
+		t.Errorf("SASL enabled: %t, TLS enabled: %t; want neither", c.Net.SASL.Enable, c.Net.TLS.Enable)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("invalid config: %v", err)
+	}
+}
+
+func TestNewConfigSASLMechanisms(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		want      sarama.SASLMechanism
+		scram     bool
+	}{
+		{config.KafkaSASLPlain, sarama.SASLTypePlaintext, false},
+		{config.KafkaSASLSCRAMSHA256, sarama.SASLTypeSCRAMSHA256, true},
+		{config.KafkaSASLSCRAMSHA512, sarama.SASLTypeSCRAMSHA512, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mechanism, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.KafkaSASLMechanism = tt.mechanism
+			cfg.KafkaSASLUsername = "user"
+			cfg.KafkaSASLPassword = "pencil"
+			c, err := NewConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !c.Net.SASL.Enable || c.Net.SASL.Mechanism != tt.want {
+				t.Errorf("SASL enabled: %t, mechanism: %s; want %s", c.Net.SASL.Enable, c.Net.SASL.Mechanism, tt.want)
+			}
+			if c.Net.SASL.User != "user" || c.Net.SASL.Password != "pencil" {
+				t.Errorf("SASL credentials weren't set")
+			}
+			if (c.Net.SASL.SCRAMClientGeneratorFunc != nil) != tt.scram {
+				t.Errorf("SCRAM client generator set: %t, want %t", c.Net.SASL.SCRAMClientGeneratorFunc != nil, tt.scram)
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("invalid config: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewConfigRejectsUnknownSASLMechanism(t *testing.T) {
+	cfg := testConfig()
+	cfg.KafkaSASLMechanism = "GSSAPI"
+	if _, err := NewConfig(cfg); err == nil {
+		t.Errorf("expected an error for an unsupported SASL mechanism")
+	}
+}
+
+// TestSCRAMClientAuthenticates runs the SCRAM conversation that sarama would against a server, for each hash function
+func TestSCRAMClientAuthenticates(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *scramClient
+		hash   scram.HashGeneratorFcn
+	}{
+		{"SHA-256", newSCRAMSHA256Client(), scram.SHA256},
+		{"SHA-512", newSCRAMSHA512Client(), scram.SHA512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := tt.hash.NewClient("user", "pencil", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+			server, err := tt.hash.NewServer(func(username string) (scram.StoredCredentials, error) {
+				return credentials, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conversation := server.NewConversation()
+
+			if err := tt.client.Begin("user", "pencil", ""); err != nil {
+				t.Fatal(err)
+			}
+			challenge := ""
+			for !tt.client.Done() {
+				response, err := tt.client.Step(challenge)
+				if err != nil {
+					t.Fatalf("client failed: %v", err)
+				}
+				if tt.client.Done() {
+					break
+				}
+				if challenge, err = conversation.Step(response); err != nil {
+					t.Fatalf("server rejected client: %v", err)
+				}
+			}
+			if !conversation.Valid() {
+				t.Errorf("server didn't authenticate client")
+			}
+		})
+	}
+}
+
+func TestNewConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir)
+
+	cfg := testConfig()
+	cfg.KafkaTLS = true
+	cfg.KafkaTLSCAFile = certPath
+	cfg.KafkaTLSCertFile = certPath
+	cfg.KafkaTLSKeyFile = keyPath
+	c, err := NewConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Net.TLS.Enable || c.Net.TLS.Config == nil {
+		t.Fatalf("TLS wasn't enabled")
+	}
+	if c.Net.TLS.Config.RootCAs == nil {
+		t.Errorf("CA file wasn't used to verify brokers")
+	}
+	if len(c.Net.TLS.Config.Certificates) != 1 {
+		t.Errorf("client certificate wasn't loaded")
+	}
+}
+
+func TestNewConfigTLSWithSystemRoots(t *testing.T) {
+	cfg := testConfig()
+	cfg.KafkaTLS = true
+	c, err := NewConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Net.TLS.Enable || c.Net.TLS.Config.RootCAs != nil || len(c.Net.TLS.Config.Certificates) != 0 {
+		t.Errorf("expected TLS verified against the system's roots, without a client certificate")
+	}
+}
+
+func TestNewConfigRejectsInvalidCAFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.KafkaTLS = true
+	cfg.KafkaTLSCAFile = path
+	if _, err := NewConfig(cfg); err == nil {
+		t.Errorf("expected an error for a CA file without certificates")
+	}
+}
+
+func TestProducerConfigCompression(t *testing.T) {
+	tests := map[string]sarama.CompressionCodec{
+		"":       sarama.CompressionNone,
+		"none":   sarama.CompressionNone,
+		"gzip":   sarama.CompressionGZIP,
+		"snappy": sarama.CompressionSnappy,
+		"lz4":    sarama.CompressionLZ4,
+		"zstd":   sarama.CompressionZSTD,
+	}
+	for compression, want := range tests {
+		t.Run(compression, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.KafkaCompression = compression
+			c, err := ProducerConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Producer.Compression != want {
+				t.Errorf("Compression = %s, want %s", c.Producer.Compression, want)
+			}
+			if !c.Producer.Return.Successes || c.Producer.RequiredAcks != sarama.WaitForAll {
+				t.Errorf("sync producers must wait for every in-sync replica and return successes")
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("invalid config: %v", err)
+			}
+		})
+	}
+
+	cfg := testConfig()
+	cfg.KafkaCompression = "brotli"
+	if _, err := ProducerConfig(cfg); err == nil {
+		t.Errorf("expected an error for unsupported compression")
+	}
+}
+
+func TestProducerConfigIdempotence(t *testing.T) {
+	cfg := testConfig()
+	cfg.KafkaIdempotentProducer = true
+	c, err := ProducerConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Producer.Idempotent {
+		t.Errorf("producer isn't idempotent")
+	}
+	if c.Net.MaxOpenRequests != 1 {
+		t.Errorf("MaxOpenRequests = %d, want 1 so that the broker sees requests in order", c.Net.MaxOpenRequests)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("invalid config: %v", err)
+	}
+
+	cfg.KafkaIdempotentProducer = false
+	if c, err = ProducerConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if c.Producer.Idempotent || c.Net.MaxOpenRequests == 1 {
+		t.Errorf("idempotence settings applied to a producer that isn't idempotent")
+	}
+}
+
+func TestConsumerGroupConfigRebalanceStrategy(t *testing.T) {
+	tests := map[string]string{
+		"":           sarama.RoundRobinBalanceStrategyName,
+		"roundrobin": sarama.RoundRobinBalanceStrategyName,
+		"range":      sarama.RangeBalanceStrategyName,
+		"sticky":     sarama.StickyBalanceStrategyName,
+	}
+	for strategy, want := range tests {
+		t.Run(strategy, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.KafkaRebalanceStrategy = strategy
+			c, err := ConsumerGroupConfig(cfg, sarama.OffsetOldest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			strategies := c.Consumer.Group.Rebalance.GroupStrategies
+			if len(strategies) != 1 || strategies[0].Name() != want {
+				t.Errorf("got %d strategies, want only %s", len(strategies), want)
+			}
+			if c.Consumer.Offsets.Initial != sarama.OffsetOldest {
+				t.Errorf("Offsets.Initial = %d, want %d", c.Consumer.Offsets.Initial, sarama.OffsetOldest)
+			}
+			if c.Consumer.Group.Session.Timeout != cfg.KafkaSessionTimeout || c.Consumer.Group.Heartbeat.Interval != cfg.KafkaHeartbeatInterval {
+				t.Errorf("session timeout and heartbeat interval weren't set")
+			}
+			if err := c.Validate(); err != nil {
+				t.Errorf("invalid config: %v", err)
+			}
+		})
+	}
+
+	cfg := testConfig()
+	cfg.KafkaRebalanceStrategy = "cooperative-sticky"
+	if _, err := ConsumerGroupConfig(cfg, sarama.OffsetNewest); err == nil {
+		t.Errorf("expected an error for an unsupported rebalance strategy")
+	}
+}
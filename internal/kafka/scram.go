@@ -0,0 +1,31 @@
+package kafka
+
+import (
+	"github.com/xdg-go/scram"
+)
+
+// scramClient adapts a SCRAM client conversation (RFC 5802) to sarama's SCRAMClient interface
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func newSCRAMSHA256Client() *scramClient { return &scramClient{hashGenerator: scram.SHA256} }
+func newSCRAMSHA512Client() *scramClient { return &scramClient{hashGenerator: scram.SHA512} }
+
+func (c *scramClient) Begin(username, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
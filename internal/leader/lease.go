@@ -0,0 +1,203 @@
+// Package leader elects a single leader among replicas of a service using a lease stored in Cassandra. Leases are
+// rows written with lightweight transactions and a TTL, so a leader that stops renewing its lease (e.g. because it
+// crashed) loses it once the TTL expires and another replica can take over.
+package leader
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Elector competes for a named lease on behalf of Holder
+type Elector struct {
+	Session *gocql.Session
+	// Name identifies the lease, e.g. the name of the job that only one replica should run
+	Name string
+	// Holder uniquely identifies this replica
+	Holder string
+	// TTL is how long the lease lasts without being renewed. It is renewed every third of the TTL.
+	TTL time.Duration
+
+	// store is where the lease is kept; it is the leases table in Session unless set otherwise
+	store leaseStore
+
+	mu          sync.Mutex
+	leaderUntil time.Time
+	// term is closed when this replica stops being leader, and is nil while it isn't
+	term chan struct{}
+}
+
+// leaseStore acquires, renews and releases leases
+type leaseStore interface {
+	// acquire writes the lease for holder if nobody holds it or holder already does, reporting whether it did
+	acquire(name, holder string, ttl time.Duration) (bool, error)
+	release(name, holder string) error
+}
+
+// IsLeader reports whether this replica held the lease when it was last acquired or renewed and the lease has not
+// expired since
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.leaderUntil)
+}
+
+// LeaderContext returns a context that is cancelled when this replica stops being leader, whether because it lost or
+// released the lease or failed to renew it before it expired, or when parent is cancelled. Work that only the leader
+// may do should use it, so that it stops rather than overlapping with a new leader's. If this replica isn't leader,
+// the context is already cancelled.
+func (e *Elector) LeaderContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	e.mu.Lock()
+	term, until := e.term, e.leaderUntil
+	e.mu.Unlock()
+	if term == nil || !time.Now().Before(until) {
+		cancel()
+		return ctx, cancel
+	}
+
+	go func() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-term:
+				cancel()
+				return
+			case <-timer.C:
+				// The lease may have been renewed since the timer was set
+				e.mu.Lock()
+				current, until := e.term, e.leaderUntil
+				e.mu.Unlock()
+				if current != term || !time.Now().Before(until) {
+					cancel()
+					return
+				}
+				timer.Reset(time.Until(until))
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// Run acquires or renews the lease until ctx is cancelled, then releases it if it is held
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		e.TryAcquire()
+
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TryAcquire acquires the lease if nobody holds it, or renews it if this replica does. Run calls it periodically; it
+// only needs to be called directly to find out whether this replica is leader before Run has started.
+func (e *Elector) TryAcquire() {
+	// Measure expiry from before the query so that this replica never believes it is leader after the lease expires
+	start := time.Now()
+	wasLeader := e.IsLeader()
+
+	acquired, err := e.leases().acquire(e.Name, e.Holder, e.TTL)
+	if err != nil {
+		// Leadership lapses naturally when leaderUntil passes, so there is nothing else to do
+		log.Printf("Failed to acquire lease %s: %v", e.Name, err)
+		return
+	}
+
+	e.mu.Lock()
+	if acquired {
+		if !wasLeader {
+			// A previous term may have lapsed without anything noticing
+			e.endTerm()
+			e.term = make(chan struct{})
+		}
+		e.leaderUntil = start.Add(e.TTL)
+	} else {
+		e.leaderUntil = time.Time{}
+		e.endTerm()
+	}
+	e.mu.Unlock()
+
+	if acquired && !wasLeader {
+		log.Printf("%s is now the leader for %s", e.Holder, e.Name)
+	} else if !acquired && wasLeader {
+		log.Printf("%s is no longer the leader for %s", e.Holder, e.Name)
+	}
+}
+
+// endTerm cancels the contexts returned by LeaderContext. e.mu must be held.
+func (e *Elector) endTerm() {
+	if e.term != nil {
+		close(e.term)
+		e.term = nil
+	}
+}
+
+func (e *Elector) leases() leaseStore {
+	if e.store != nil {
+		return e.store
+	}
+	return &cassandraLeases{session: e.Session}
+}
+
+// release gives up the lease so that another replica can take over without waiting for it to expire
+func (e *Elector) release() {
+	e.mu.Lock()
+	e.leaderUntil = time.Time{}
+	e.endTerm()
+	e.mu.Unlock()
+
+	if err := e.leases().release(e.Name, e.Holder); err != nil {
+		log.Printf("Failed to release lease %s: %v", e.Name, err)
+	}
+}
+
+// cassandraLeases keeps leases in the leases table
+type cassandraLeases struct {
+	session *gocql.Session
+}
+
+func (l *cassandraLeases) acquire(name, holder string, ttl time.Duration) (bool, error) {
+	seconds := int(ttl.Seconds())
+
+	existing := map[string]interface{}{}
+	applied, err := l.session.Query(
+		`INSERT INTO leases (name, holder) VALUES (?, ?) IF NOT EXISTS USING TTL ?`,
+		name, holder, seconds,
+	).MapScanCAS(existing)
+	if err != nil || applied {
+		return applied, err
+	}
+	if existing["holder"] != holder {
+		return false, nil
+	}
+
+	// This replica already holds the lease, so extend it
+	return l.session.Query(
+		`UPDATE leases USING TTL ? SET holder = ? WHERE name = ? IF holder = ?`,
+		seconds, holder, name, holder,
+	).MapScanCAS(existing)
+}
+
+func (l *cassandraLeases) release(name, holder string) error {
+	existing := map[string]interface{}{}
+	_, err := l.session.Query(
+		`DELETE FROM leases WHERE name = ? IF holder = ?`,
+		name, holder,
+	).MapScanCAS(existing)
+	return err
+}
@@ -0,0 +1,164 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLeases is a leaseStore that keeps leases in memory. Holders in unreachable get errors, as if partitioned from
+// the database.
+type memoryLeases struct {
+	mu          sync.Mutex
+	holders     map[string]string
+	expiries    map[string]time.Time
+	unreachable map[string]bool
+}
+
+func newMemoryLeases() *memoryLeases {
+	return &memoryLeases{holders: map[string]string{}, expiries: map[string]time.Time{}, unreachable: map[string]bool{}}
+}
+
+func (l *memoryLeases) acquire(name, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unreachable[holder] {
+		return false, errors.New("unreachable")
+	}
+	if current, ok := l.holders[name]; ok && current != holder && time.Now().Before(l.expiries[name]) {
+		return false, nil
+	}
+	l.holders[name] = holder
+	l.expiries[name] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (l *memoryLeases) release(name, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holders[name] == holder {
+		delete(l.holders, name)
+	}
+	return nil
+}
+
+func (l *memoryLeases) setUnreachable(holder string, unreachable bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.unreachable[holder] = unreachable
+}
+
+const testTTL = 300 * time.Millisecond
+
+func newTestElector(store leaseStore, holder string) *Elector {
+	return &Elector{Name: "test", Holder: holder, TTL: testTTL, store: store}
+}
+
+func waitForCancel(t *testing.T, ctx context.Context, within time.Duration) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+	case <-time.After(within):
+		t.Fatalf("context wasn't cancelled within %s", within)
+	}
+}
+
+func TestFailoverCancelsLeaderContextWhenLeaseCantBeRenewed(t *testing.T) {
+	store := newMemoryLeases()
+	a, b := newTestElector(store, "a"), newTestElector(store, "b")
+
+	a.TryAcquire()
+	b.TryAcquire()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("expected a to lead, got a: %t, b: %t", a.IsLeader(), b.IsLeader())
+	}
+	ctx, cancel := a.LeaderContext(context.Background())
+	defer cancel()
+
+	// a can no longer renew its lease, so b takes over once it expires
+	store.setUnreachable("a", true)
+	deadline := time.Now().Add(3 * testTTL)
+	for !b.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(testTTL / 10)
+		a.TryAcquire()
+		b.TryAcquire()
+	}
+	if !b.IsLeader() {
+		t.Fatalf("b didn't take over within %s", 3*testTTL)
+	}
+
+	// a's lease is measured from before it was written, so expires before b can take over. Allow for the context
+	// being cancelled by another goroutine.
+	waitForCancel(t, ctx, testTTL/10)
+	if a.IsLeader() {
+		t.Errorf("a still believes it is leader after b took over")
+	}
+}
+
+func TestLeaderContextSurvivesRenewals(t *testing.T) {
+	store := newMemoryLeases()
+	a := newTestElector(store, "a")
+	a.TryAcquire()
+	ctx, cancel := a.LeaderContext(context.Background())
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(testTTL / 3)
+		a.TryAcquire()
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("leader context was cancelled even though the lease was renewed")
+	}
+}
+
+func TestLeaderContextIsCancelledWhenLeaseIsLost(t *testing.T) {
+	store := newMemoryLeases()
+	a := newTestElector(store, "a")
+	a.TryAcquire()
+	ctx, cancel := a.LeaderContext(context.Background())
+	defer cancel()
+
+	// Another replica wrote the lease, e.g. after a's expired while it was paused
+	store.mu.Lock()
+	store.holders["test"] = "b"
+	store.mu.Unlock()
+	a.TryAcquire()
+
+	waitForCancel(t, ctx, testTTL/10)
+}
+
+func TestLeaderContextIsCancelledOnShutdown(t *testing.T) {
+	store := newMemoryLeases()
+	a := newTestElector(store, "a")
+	a.TryAcquire()
+	leaderCtx, cancelLeader := a.LeaderContext(context.Background())
+	defer cancelLeader()
+
+	runCtx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(runCtx)
+		close(done)
+	}()
+	stop()
+	<-done
+
+	// Run releases the lease on shutdown, so work using it must stop straight away
+	waitForCancel(t, leaderCtx, testTTL/10)
+	b := newTestElector(store, "b")
+	b.TryAcquire()
+	if !b.IsLeader() {
+		t.Errorf("another replica couldn't take over the released lease")
+	}
+}
+
+func TestLeaderContextIsCancelledWhenNotLeader(t *testing.T) {
+	a := newTestElector(newMemoryLeases(), "a")
+	ctx, cancel := a.LeaderContext(context.Background())
+	defer cancel()
+	if ctx.Err() == nil {
+		t.Fatalf("expected a cancelled context for a replica that isn't leader")
+	}
+}
@@ -0,0 +1,127 @@
+package lifecycle
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Service runs a gRPC server alongside background work until the process is asked to stop, then shuts everything
+// down in order: it cancels the background work's context and stops accepting RPCs, waits for in-flight RPCs and
+// background work to finish, then closes resources such as Kafka producers and Cassandra sessions.
+type Service struct {
+	timeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	background sync.WaitGroup
+	closers    []closer
+}
+
+type closer struct {
+	name  string
+	close func() error
+}
+
+// New returns a Service that gives in-flight RPCs and background work up to timeout to finish on shutdown
+func New(timeout time.Duration) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{timeout: timeout, ctx: ctx, cancel: cancel}
+}
+
+// Context is cancelled when shutdown starts
+func (s *Service) Context() context.Context {
+	return s.ctx
+}
+
+// Go runs f in the background. f should return soon after ctx is cancelled; shutdown waits for it before closing
+// resources.
+func (s *Service) Go(f func(ctx context.Context)) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f(s.ctx)
+	}()
+}
+
+// OnClose registers a resource to close once RPCs and background work have finished. Resources are closed in the
+// reverse of the order they are registered in, like deferred calls, so register each one as soon as it is opened.
+func (s *Service) OnClose(name string, close func() error) {
+	s.closers = append(s.closers, closer{name: name, close: close})
+}
+
+// Serve serves RPCs on lis until the process receives SIGINT or SIGTERM, or the server fails, then shuts down
+func (s *Service) Serve(server *grpc.Server, lis net.Listener) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(lis)
+	}()
+
+	var err error
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down...", sig)
+	case err = <-served:
+		log.Printf("Server stopped unexpectedly, shutting down: %v", err)
+	}
+
+	s.shutdown(server)
+	return err
+}
+
+func (s *Service) shutdown(server *grpc.Server) {
+	deadline := time.Now().Add(s.timeout)
+	s.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	if !waitUntil(stopped, deadline) {
+		log.Printf("In-flight RPCs didn't finish within %s, cancelling them", s.timeout)
+		server.Stop()
+		<-stopped
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(finished)
+	}()
+	if !waitUntil(finished, deadline) {
+		log.Printf("Background work didn't finish within %s, closing resources anyway", s.timeout)
+	}
+
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		c := s.closers[i]
+		if err := c.close(); err != nil {
+			log.Printf("Failed to close %s: %v", c.name, err)
+		}
+	}
+}
+
+// waitUntil waits for done to be closed, returning false if deadline passes first
+func waitUntil(done <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
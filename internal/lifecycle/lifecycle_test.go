@@ -0,0 +1,141 @@
+package lifecycle
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// events records what happened during shutdown, in order
+type events struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *events) record(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *events) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.events)
+}
+
+// serve starts a server that handles every RPC with handler, and starts an RPC that it waits to be handled
+func serve(t *testing.T, handler func(ctx context.Context)) *grpc.Server {
+	t.Helper()
+	started := make(chan struct{})
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		close(started)
+		handler(stream.Context())
+		return nil
+	}))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Invoke(context.Background(), "/test.Service/Method", &emptypb.Empty{}, &emptypb.Empty{})
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RPC wasn't started")
+	}
+	return server
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var e events
+	s := New(5 * time.Second)
+	s.OnClose("first", func() error {
+		e.record("close first")
+		return nil
+	})
+	s.OnClose("second", func() error {
+		e.record("close second")
+		return nil
+	})
+	s.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		e.record("background cancelled")
+		// Still finishing, so shutdown must wait rather than close resources it uses
+		time.Sleep(100 * time.Millisecond)
+		e.record("background finished")
+	})
+	server := serve(t, func(ctx context.Context) {
+		// Shutdown lets in-flight RPCs finish rather than cancelling them
+		select {
+		case <-ctx.Done():
+			e.record("RPC cancelled")
+		case <-time.After(50 * time.Millisecond):
+			e.record("RPC finished")
+		}
+	})
+
+	s.shutdown(server)
+
+	got := e.get()
+	want := []string{"background cancelled", "RPC finished", "background finished", "close second", "close first"}
+	if !slices.Equal(got, want) {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
+
+func TestShutdownStopsAtDeadline(t *testing.T) {
+	var e events
+	timeout := 200 * time.Millisecond
+	s := New(timeout)
+	s.OnClose("resource", func() error {
+		e.record("close")
+		return nil
+	})
+	// Background work that ignores cancellation mustn't stop resources from being closed
+	blocked := make(chan struct{})
+	defer close(blocked)
+	s.Go(func(ctx context.Context) {
+		<-blocked
+	})
+	cancelled := make(chan struct{})
+	server := serve(t, func(ctx context.Context) {
+		// Only stops once shutdown gives up waiting and cancels it
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	start := time.Now()
+	s.shutdown(server)
+	elapsed := time.Since(start)
+
+	if elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Errorf("shutdown took %s, want about %s", elapsed, timeout)
+	}
+	if s.Context().Err() == nil {
+		t.Errorf("background work's context wasn't cancelled")
+	}
+	if got := e.get(); !slices.Equal(got, []string{"close"}) {
+		t.Errorf("events %v, want the resource closed", got)
+	}
+	// Shutdown doesn't wait for the handler to return once it has cancelled the RPC
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("RPC wasn't cancelled")
+	}
+}
@@ -0,0 +1,108 @@
+package notifications
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gocql/gocql"
+	"github.com/linkedin/goavro/v2"
+)
+
+// StatusTopic is the topic that notification status changed events are published to
+const StatusTopic = "notification-status"
+
+// Statuses that a notification moves through
+const (
+	// StatusWaiting means the notification is due but is being held back, e.g. during quiet hours
+	StatusWaiting = "waiting"
+	// StatusQueued means a command to send the notification has been published
+	StatusQueued = "queued"
+	// StatusSent means the email or SMS service has confirmed delivery
+	StatusSent = "sent"
+)
+
+// namespace is used to derive notification IDs from idempotency keys
+var namespace = gocql.UUID{0x6c, 0x69, 0x62, 0x72, 0x61, 0x72, 0x79, 0x2d, 0x6e, 0x6f, 0x74, 0x69, 0x66, 0x79, 0x00, 0x01}
+
+// IDFromKey derives a notification's ID from its idempotency key (as a version 5 UUID), so that a notification that
+// is considered more than once keeps the same ID
+func IDFromKey(idempotencyKey string) gocql.UUID {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(idempotencyKey))
+	var id gocql.UUID
+	copy(id[:], h.Sum(nil))
+	id[6] = (id[6] & 0x0f) | 0x50
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+// StatusChanged is published when the email or SMS service changes a notification's status
+type StatusChanged struct {
+	NotificationID gocql.UUID
+	RecipientID    gocql.UUID
+	Status         string
+	ChangedAt      time.Time
+}
+
+// LoadStatusCodec reads the Avro schema for status changed events
+func LoadStatusCodec(schemaPath string) (*goavro.Codec, error) {
+	schemaFile, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	return goavro.NewCodec(string(schemaFile))
+}
+
+// NewStatusChangedMessage serializes the event for publishing to StatusTopic
+func NewStatusChangedMessage(codec *goavro.Codec, event StatusChanged) (*sarama.ProducerMessage, error) {
+	binary, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"notificationId": event.NotificationID.String(),
+		"recipientId":    event.RecipientID.String(),
+		"status":         event.Status,
+		"changedAt":      event.ChangedAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize status changed event: %w", err)
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: StatusTopic,
+		// Key by recipient so that events for the same recipient are consumed in order
+		Key:   sarama.StringEncoder(event.RecipientID.String()),
+		Value: sarama.ByteEncoder(binary),
+	}, nil
+}
+
+// DecodeStatusChanged deserializes an event consumed from StatusTopic
+func DecodeStatusChanged(codec *goavro.Codec, value []byte) (StatusChanged, error) {
+	native, _, err := codec.NativeFromBinary(value)
+	if err != nil {
+		return StatusChanged{}, fmt.Errorf("failed to deserialize status changed event: %w", err)
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return StatusChanged{}, fmt.Errorf("unexpected message format")
+	}
+
+	notificationID, err := gocql.ParseUUID(fmt.Sprint(record["notificationId"]))
+	if err != nil {
+		return StatusChanged{}, fmt.Errorf("invalid notification ID: %w", err)
+	}
+	recipientID, err := gocql.ParseUUID(fmt.Sprint(record["recipientId"]))
+	if err != nil {
+		return StatusChanged{}, fmt.Errorf("invalid recipient ID: %w", err)
+	}
+	status, _ := record["status"].(string)
+	changedAt, _ := record["changedAt"].(time.Time)
+
+	return StatusChanged{
+		NotificationID: notificationID,
+		RecipientID:    recipientID,
+		Status:         status,
+		ChangedAt:      changedAt,
+	}, nil
+}
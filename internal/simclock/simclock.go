@@ -0,0 +1,74 @@
+package simclock
+
+import (
+	"context"
+	"time"
+
+	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
+	simclockv1 "github.com/mattgallagher92/library-book-tracker/proto/simclock/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Register serves the SimulatedClock service on server, controlling provider. If provider isn't simulated, every
+// RPC fails with FailedPrecondition.
+func Register(server *grpc.Server, provider timeProvider.Provider) {
+	simclockv1.RegisterSimulatedClockServer(server, &clockServer{provider: provider})
+}
+
+type clockServer struct {
+	simclockv1.UnimplementedSimulatedClockServer
+	provider timeProvider.Provider
+}
+
+func (s *clockServer) simulated() (*timeProvider.SimulatedProvider, error) {
+	if provider, ok := s.provider.(*timeProvider.SimulatedProvider); ok {
+		return provider, nil
+	}
+	return nil, status.Error(codes.FailedPrecondition, "time simulation not enabled")
+}
+
+func (s *clockServer) Set(ctx context.Context, req *simclockv1.SetRequest) (*simclockv1.SetResponse, error) {
+	provider, err := s.simulated()
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid timestamp format: %v", err)
+	}
+	if req.Rate < 0 {
+		return nil, status.Error(codes.InvalidArgument, "rate must not be negative")
+	}
+
+	provider.SetClock(timeProvider.Clock{Time: t, Rate: req.Rate, Paused: req.Paused})
+	return &simclockv1.SetResponse{}, nil
+}
+
+func (s *clockServer) Get(ctx context.Context, req *simclockv1.GetRequest) (*simclockv1.GetResponse, error) {
+	provider, err := s.simulated()
+	if err != nil {
+		return nil, err
+	}
+
+	clock := provider.Clock()
+	return &simclockv1.GetResponse{
+		Timestamp: clock.Time.Format(time.RFC3339),
+		Rate:      clock.Rate,
+		Paused:    clock.Paused,
+	}, nil
+}
+
+func (s *clockServer) Advance(ctx context.Context, req *simclockv1.AdvanceRequest) (*simclockv1.AdvanceResponse, error) {
+	provider, err := s.simulated()
+	if err != nil {
+		return nil, err
+	}
+
+	newTime := provider.Now().Add(time.Duration(req.Seconds) * time.Second)
+	provider.SetTime(newTime)
+	return &simclockv1.AdvanceResponse{
+		NewTimestamp: newTime.Format(time.RFC3339),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Message is an SMS ready to be delivered
+type Message struct {
+	To   string
+	Body string
+}
+
+// Gateway delivers SMS messages. Send must only return nil once the gateway has accepted the message.
+type Gateway interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LoggingGateway logs messages instead of delivering them, for development and tests
+type LoggingGateway struct{}
+
+func (g *LoggingGateway) Send(ctx context.Context, msg Message) error {
+	log.Printf("sending SMS...\nTo: %s\nBody: %s", msg.To, msg.Body)
+	return nil
+}
+
+// WebhookGateway delivers messages by POSTing them as JSON to an SMS provider's webhook
+type WebhookGateway struct {
+	URL string
+	// AuthToken is sent as a bearer token if set
+	AuthToken string
+	Client    *http.Client
+}
+
+type webhookRequest struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+func (g *WebhookGateway) Send(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(webhookRequest{To: msg.To, Body: msg.Body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+g.AuthToken)
+	}
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call SMS webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("SMS webhook responded with status %s", resp.Status)
+	// Other client errors mean the request itself is bad, so retrying won't help
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return &permanentError{err}
+	}
+	return err
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// IsPermanent reports whether retrying a failed send can never succeed
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
@@ -0,0 +1,58 @@
+package sms
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/i18n"
+)
+
+// Templates renders SMS messages from <id>.txt.tmpl files in a directory. Templates can use the localisation
+// functions described by i18n.Catalogs.Funcs.
+type Templates struct {
+	text     *template.Template
+	catalogs *i18n.Catalogs
+}
+
+// LoadTemplates parses the template files in dir
+func LoadTemplates(dir string, catalogs *i18n.Catalogs) (*Templates, error) {
+	text, err := template.New("").Option("missingkey=error").Funcs(i18n.PlaceholderFuncs).ParseGlob(filepath.Join(dir, "*.txt.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SMS templates: %w", err)
+	}
+	return &Templates{text: text, catalogs: catalogs}, nil
+}
+
+// Render creates the SMS to send to toNumber in the given locale using the named template. Templates can refer to
+// params by name and range over items as .items.
+func (t *Templates) Render(templateID string, locale string, toNumber string, params map[string]string, items []map[string]string) (Message, error) {
+	name := templateID + ".txt.tmpl"
+	if t.text.Lookup(name) == nil {
+		return Message{}, fmt.Errorf("unknown template %q", templateID)
+	}
+
+	text, err := t.text.Clone()
+	if err != nil {
+		return Message{}, err
+	}
+	text.Funcs(t.catalogs.Funcs(locale))
+
+	data := make(map[string]any, len(params)+1)
+	for k, v := range params {
+		data[k] = v
+	}
+	data["items"] = items
+
+	var body bytes.Buffer
+	if err := text.ExecuteTemplate(&body, name, data); err != nil {
+		return Message{}, fmt.Errorf("failed to render body: %w", err)
+	}
+
+	return Message{
+		To:   toNumber,
+		Body: strings.TrimSpace(body.String()),
+	}, nil
+}
@@ -0,0 +1,4 @@
+package sms
+
+// CommandTopic is the topic that send SMS commands are published to
+const CommandTopic = "send-sms-command"
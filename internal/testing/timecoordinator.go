@@ -4,37 +4,87 @@ import (
 	"context"
 	"time"
 
-	loansv1 "github.com/mattgallagher92/library-book-tracker/proto/loans/v1"
+	timeProvider "github.com/mattgallagher92/library-book-tracker/internal/time"
+	simclockv1 "github.com/mattgallagher92/library-book-tracker/proto/simclock/v1"
+	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
 )
 
+// SimulatedTimeUpdater is anything whose simulated time a test can set, whether a service reached over gRPC or a
+// provider in the test's own process
+type SimulatedTimeUpdater interface {
+	SetSimulatedTime(ctx context.Context, t time.Time) error
+}
+
+// SimulatedTimeUpdaterFunc adapts a function to a SimulatedTimeUpdater
+type SimulatedTimeUpdaterFunc func(ctx context.Context, t time.Time) error
+
+func (f SimulatedTimeUpdaterFunc) SetSimulatedTime(ctx context.Context, t time.Time) error {
+	return f(ctx, t)
+}
+
+// SimulatedClockClient updates the simulated time of any service serving the SimulatedClock service
+func SimulatedClockClient(client simclockv1.SimulatedClockClient) SimulatedTimeUpdater {
+	return SimulatedTimeUpdaterFunc(func(ctx context.Context, t time.Time) error {
+		_, err := client.Set(ctx, &simclockv1.SetRequest{
+			Timestamp: t.Format(time.RFC3339Nano),
+			Paused:    true,
+		})
+		return err
+	})
+}
+
+// TimeServiceClient sets the time service's simulated time, which it sends on to every registered service
+func TimeServiceClient(client timev1.TimeServiceClient) SimulatedTimeUpdater {
+	return SimulatedTimeUpdaterFunc(func(ctx context.Context, t time.Time) error {
+		_, err := client.SetTime(ctx, &timev1.SetTimeRequest{Timestamp: t.Format(time.RFC3339)})
+		return err
+	})
+}
+
+// Provider sets the time of a simulated provider in the test's own process
+func Provider(provider *timeProvider.SimulatedProvider) SimulatedTimeUpdater {
+	return SimulatedTimeUpdaterFunc(func(ctx context.Context, t time.Time) error {
+		provider.SetTime(t)
+		return nil
+	})
+}
+
+// TimeCoordinator keeps the simulated time of several services in step, tracking the time it last set so that it can
+// be advanced from there
 type TimeCoordinator struct {
-	clients []loansv1.LoansServiceClient
+	updaters []SimulatedTimeUpdater
+	current  time.Time
 }
 
-func NewTimeCoordinator(clients []loansv1.LoansServiceClient) *TimeCoordinator {
+func NewTimeCoordinator(start time.Time, updaters ...SimulatedTimeUpdater) *TimeCoordinator {
 	return &TimeCoordinator{
-		clients: clients,
+		updaters: updaters,
+		current:  start,
 	}
 }
 
+// Now returns the simulated time the coordinator last set, or its start time
+func (c *TimeCoordinator) Now() time.Time {
+	return c.current
+}
+
+// SetTime sets the time of every updater, stopping at the first that fails. The tracked time is only changed once
+// they have all been updated.
 func (c *TimeCoordinator) SetTime(t time.Time) error {
-	req := &loansv1.UpdateSimulatedTimeRequest{
-		Timestamp: t.Format(time.RFC3339),
-	}
-	
-	for _, client := range c.clients {
-		if _, err := client.UpdateSimulatedTime(context.Background(), req); err != nil {
+	for _, updater := range c.updaters {
+		if err := updater.SetSimulatedTime(context.Background(), t); err != nil {
 			return err
 		}
 	}
+	c.current = t
 	return nil
 }
 
 func (c *TimeCoordinator) AdvanceBy(d time.Duration) error {
-	t := time.Now().Add(d)
-	return c.SetTime(t)
+	return c.SetTime(c.current.Add(d))
 }
 
+// AdvanceDays moves forward by calendar days, so the time of day stays the same across daylight saving changes
 func (c *TimeCoordinator) AdvanceDays(days int) error {
-	return c.AdvanceBy(24 * time.Hour * time.Duration(days))
+	return c.SetTime(c.current.AddDate(0, 0, days))
 }
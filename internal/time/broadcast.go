@@ -0,0 +1,176 @@
+package time
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	"github.com/mattgallagher92/library-book-tracker/internal/kafka"
+)
+
+// TimeChangedTopic is the compacted topic that the time service publishes simulated time to when broadcasting over
+// Kafka. Every event has the same key, so compaction keeps the latest time for services that start later.
+const TimeChangedTopic = "simulated-time"
+
+const timeChangedKey = "time"
+
+// LoadTimeChangedCodec reads the Avro schema for time changed events
+func LoadTimeChangedCodec(schemaPath string) (*goavro.Codec, error) {
+	schemaFile, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	return goavro.NewCodec(string(schemaFile))
+}
+
+// NewTimeChangedMessage serializes the time service's clock for publishing to TimeChangedTopic whenever it is set,
+// paused or resumed or its rate changes
+func NewTimeChangedMessage(codec *goavro.Codec, clock Clock) (*sarama.ProducerMessage, error) {
+	binary, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"time":   clock.Time,
+		"rate":   clock.Rate,
+		"paused": clock.Paused,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize time changed event: %w", err)
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: TimeChangedTopic,
+		Key:   sarama.StringEncoder(timeChangedKey),
+		Value: sarama.ByteEncoder(binary),
+	}, nil
+}
+
+// DecodeTimeChanged deserializes an event consumed from TimeChangedTopic. If the clock was running, its time is
+// advanced by the time since the event was published.
+func DecodeTimeChanged(codec *goavro.Codec, message *sarama.ConsumerMessage) (Clock, error) {
+	native, _, err := codec.NativeFromBinary(message.Value)
+	if err != nil {
+		return Clock{}, fmt.Errorf("failed to deserialize time changed event: %w", err)
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return Clock{}, fmt.Errorf("unexpected message format")
+	}
+	clock := Clock{}
+	clock.Time, _ = record["time"].(time.Time)
+	clock.Rate, _ = record["rate"].(float64)
+	clock.Paused, _ = record["paused"].(bool)
+
+	if !clock.Paused && !message.Timestamp.IsZero() {
+		clock.Time = clock.Time.Add(time.Duration(float64(time.Since(message.Timestamp)) * clock.Rate))
+	}
+	return clock, nil
+}
+
+// latestTimeChangedTimeout limits how long LatestTimeChanged waits for the latest event to be fetched
+const latestTimeChangedTimeout = 30 * time.Second
+
+// LatestTimeChanged returns the clock from the most recently published event, if there is one
+func LatestTimeChanged(cfg config.KafkaConfig, codec *goavro.Codec) (Clock, bool, error) {
+	client, err := kafka.NewClient(cfg)
+	if err != nil {
+		return Clock{}, false, err
+	}
+	defer client.Close()
+
+	partition, newest, err := newestOffset(client)
+	if err != nil {
+		return Clock{}, false, err
+	}
+	if newest == 0 {
+		return Clock{}, false, nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return Clock{}, false, err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(TimeChangedTopic, partition, newest-1)
+	if err != nil {
+		return Clock{}, false, err
+	}
+	defer pc.Close()
+
+	select {
+	case message := <-pc.Messages():
+		clock, err := DecodeTimeChanged(codec, message)
+		return clock, err == nil, err
+	case err := <-pc.Errors():
+		return Clock{}, false, err
+	case <-time.After(latestTimeChangedTimeout):
+		return Clock{}, false, fmt.Errorf("timed out after %s fetching the latest event from %s", latestTimeChangedTimeout, TimeChangedTopic)
+	}
+}
+
+// newestOffset returns the partition that events are published to and the offset of the next event. All events have
+// the same key, so are in the same partition.
+func newestOffset(client sarama.Client) (int32, int64, error) {
+	partitions, err := client.Partitions(TimeChangedTopic)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get partitions of %s: %w", TimeChangedTopic, err)
+	}
+	if len(partitions) != 1 {
+		return 0, 0, fmt.Errorf("%s must have exactly one partition, has %d", TimeChangedTopic, len(partitions))
+	}
+	newest, err := client.GetOffset(TimeChangedTopic, partitions[0], sarama.OffsetNewest)
+	return partitions[0], newest, err
+}
+
+// Follow sets the provider's clock from the events published to TimeChangedTopic, starting with the latest, until ctx
+// is cancelled. Every replica follows the topic independently, so each receives every event.
+func Follow(ctx context.Context, cfg config.KafkaConfig, codec *goavro.Codec, provider *SimulatedProvider) error {
+	client, err := kafka.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	partition, newest, err := newestOffset(client)
+	if err != nil {
+		return err
+	}
+	// Start from the latest event rather than replaying every earlier time
+	offset := sarama.OffsetOldest
+	if newest > 0 {
+		offset = newest - 1
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(TimeChangedTopic, partition, offset)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	log.Printf("Following simulated time on %s", TimeChangedTopic)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message := <-pc.Messages():
+			clock, err := DecodeTimeChanged(codec, message)
+			if err != nil {
+				log.Printf("Failed to decode time changed event at offset %d: %v", message.Offset, err)
+				continue
+			}
+			provider.SetClock(clock)
+			log.Printf("Simulated time is now %s (rate %g, paused %t)", clock.Time.Format(time.RFC3339), clock.Rate, clock.Paused)
+		case err := <-pc.Errors():
+			log.Printf("Error following simulated time: %v", err)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package time
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
 
 type Provider interface {
 	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a ticker that sends the time on its channel every period. Like time.Ticker, it drops ticks
+	// for slow receivers.
+	NewTicker(d time.Duration) Ticker
+	// Sleep pauses the current goroutine for at least the duration
+	Sleep(d time.Duration)
+}
+
+// Ticker is the subset of time.Ticker used by services, so that simulated tickers can be used instead
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
 }
 
 type RealProvider struct{}
@@ -15,23 +29,262 @@ func (p *RealProvider) Now() time.Time {
 	return time.Now()
 }
 
+func (p *RealProvider) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (p *RealProvider) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (p *RealProvider) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t *realTicker) Stop()               { t.ticker.Stop() }
+
+// SimulatedProvider's time starts paused, so it only moves when SetTime is called. Once resumed, it flows at Rate
+// times real time, e.g. a rate of 1440 makes a simulated day pass every real minute. Timers and tickers fire when
+// simulated time reaches their deadlines, in deadline order, so scheduled work follows simulated time.
 type SimulatedProvider struct {
-	mu          sync.RWMutex
-	currentTime time.Time
+	mu sync.RWMutex
+	// baseTime is the simulated time at baseReal, the real time when the clock was last set, paused or resumed or
+	// its rate changed
+	baseTime time.Time
+	baseReal time.Time
+	rate     float64
+	paused   bool
+	timers   []*simulatedTimer
+	// wake fires timers as simulated time flows while the clock is running
+	wake *time.Timer
+}
+
+// Clock is the state of a simulated clock
+type Clock struct {
+	Time time.Time
+	// Rate is the number of simulated seconds that pass per real second while the clock isn't paused
+	Rate   float64
+	Paused bool
+}
+
+// simulatedTimer is a pending After, Sleep or ticker
+type simulatedTimer struct {
+	deadline time.Time
+	// period is zero for one-off timers
+	period time.Duration
+	c      chan time.Time
 }
 
 func NewSimulatedProvider(initial time.Time) *SimulatedProvider {
-	return &SimulatedProvider{currentTime: initial}
+	return &SimulatedProvider{baseTime: initial, baseReal: time.Now(), rate: 1, paused: true}
 }
 
 func (p *SimulatedProvider) Now() time.Time {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.currentTime
+	return p.now()
+}
+
+// now must be called with p.mu held
+func (p *SimulatedProvider) now() time.Time {
+	if p.paused {
+		return p.baseTime
+	}
+	return p.baseTime.Add(time.Duration(float64(time.Since(p.baseReal)) * p.rate))
 }
 
+// Clock returns the current time, rate and whether the clock is paused
+func (p *SimulatedProvider) Clock() Clock {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return Clock{Time: p.now(), Rate: p.rate, Paused: p.paused}
+}
+
+// SetTime sets the current time, firing any timers whose deadlines have been reached. A ticker whose deadline has
+// been passed by several periods fires once, as a real ticker would for a slow receiver. If time moves backwards,
+// tickers next fire a period after the new time rather than waiting for time to catch up with their old deadlines.
 func (p *SimulatedProvider) SetTime(t time.Time) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.currentTime = t
+	p.jump(t)
+	p.fireDue()
+}
+
+// SetClock sets the time, rate and whether the clock is paused at once, e.g. to match another service's clock
+func (p *SimulatedProvider) SetClock(c Clock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.Rate > 0 {
+		p.rate = c.Rate
+	}
+	p.paused = c.Paused
+	p.jump(c.Time)
+	p.fireDue()
+}
+
+// SetRate changes how fast simulated time flows while the clock isn't paused. It panics if rate is not positive.
+func (p *SimulatedProvider) SetRate(rate float64) {
+	if rate <= 0 {
+		panic("non-positive rate for SimulatedProvider.SetRate")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebase(p.now())
+	p.rate = rate
+	p.schedule()
+}
+
+// Pause stops simulated time flowing, so that it only moves when SetTime is called
+func (p *SimulatedProvider) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebase(p.now())
+	p.paused = true
+	p.schedule()
+}
+
+// Resume starts simulated time flowing from the current simulated time
+func (p *SimulatedProvider) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebase(p.now())
+	p.paused = false
+	p.schedule()
+}
+
+// rebase must be called with p.mu held
+func (p *SimulatedProvider) rebase(t time.Time) {
+	p.baseTime = t
+	p.baseReal = time.Now()
+}
+
+// jump sets the current time, bringing forward tickers whose next deadlines are more than a period after it. It must be
+// called with p.mu held.
+func (p *SimulatedProvider) jump(t time.Time) {
+	if t.Before(p.now()) {
+		for _, timer := range p.timers {
+			if next := t.Add(timer.period); timer.period > 0 && timer.deadline.After(next) {
+				timer.deadline = next
+			}
+		}
+	}
+	p.rebase(t)
+}
+
+// fireDue fires the timers whose deadlines have been reached and schedules the next wake. It must be called with
+// p.mu held.
+func (p *SimulatedProvider) fireDue() {
+	t := p.now()
+
+	var due, pending []*simulatedTimer
+	for _, timer := range p.timers {
+		if timer.deadline.After(t) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].deadline.Before(due[j].deadline)
+	})
+
+	for _, timer := range due {
+		// Channels are buffered, so this only drops ticks that a ticker's receiver hasn't kept up with
+		select {
+		case timer.c <- t:
+		default:
+		}
+		if timer.period > 0 {
+			missed := t.Sub(timer.deadline) / timer.period
+			timer.deadline = timer.deadline.Add((missed + 1) * timer.period)
+			pending = append(pending, timer)
+		}
+	}
+	p.timers = pending
+	p.schedule()
+}
+
+// schedule sets a real timer to fire the next simulated timer while the clock is running. It must be called with
+// p.mu held.
+func (p *SimulatedProvider) schedule() {
+	if p.wake != nil {
+		p.wake.Stop()
+		p.wake = nil
+	}
+	if p.paused || len(p.timers) == 0 {
+		return
+	}
+
+	next := p.timers[0].deadline
+	for _, timer := range p.timers[1:] {
+		if timer.deadline.Before(next) {
+			next = timer.deadline
+		}
+	}
+	delay := time.Duration(float64(next.Sub(p.now())) / p.rate)
+	p.wake = time.AfterFunc(max(delay, 0), func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.fireDue()
+	})
 }
+
+func (p *SimulatedProvider) After(d time.Duration) <-chan time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- p.now()
+		return c
+	}
+	p.timers = append(p.timers, &simulatedTimer{deadline: p.now().Add(d), c: c})
+	p.schedule()
+	return c
+}
+
+// NewTicker panics if d is not positive, like time.NewTicker
+func (p *SimulatedProvider) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedProvider.NewTicker")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timer := &simulatedTimer{deadline: p.now().Add(d), period: d, c: make(chan time.Time, 1)}
+	p.timers = append(p.timers, timer)
+	p.schedule()
+	return &simulatedTicker{provider: p, timer: timer}
+}
+
+// Sleep blocks until simulated time has moved forward by at least d
+func (p *SimulatedProvider) Sleep(d time.Duration) {
+	<-p.After(d)
+}
+
+func (p *SimulatedProvider) remove(timer *simulatedTimer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, t := range p.timers {
+		if t == timer {
+			p.timers = append(p.timers[:i], p.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type simulatedTicker struct {
+	provider *SimulatedProvider
+	timer    *simulatedTimer
+}
+
+func (t *simulatedTicker) C() <-chan time.Time { return t.timer.c }
+func (t *simulatedTicker) Stop()               { t.provider.remove(t.timer) }
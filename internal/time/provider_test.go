@@ -0,0 +1,79 @@
+package time
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2025, time.January, 1, 9, 0, 0, 0, time.UTC)
+
+func expectTick(t *testing.T, ticker Ticker, want time.Time) {
+	t.Helper()
+	select {
+	case got := <-ticker.C():
+		if !got.Equal(want) {
+			t.Errorf("ticked at %s, want %s", got, want)
+		}
+	default:
+		t.Fatalf("didn't tick at %s", want)
+	}
+}
+
+func expectNoTick(t *testing.T, ticker Ticker) {
+	t.Helper()
+	select {
+	case got := <-ticker.C():
+		t.Fatalf("unexpectedly ticked at %s", got)
+	default:
+	}
+}
+
+func TestTickerFiresWhenTimeReachesDeadline(t *testing.T) {
+	p := NewSimulatedProvider(testStart)
+	ticker := p.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	p.SetTime(testStart.Add(59 * time.Minute))
+	expectNoTick(t, ticker)
+	p.SetTime(testStart.Add(time.Hour))
+	expectTick(t, ticker, testStart.Add(time.Hour))
+
+	// Skipping several periods ticks once, then carries on from the next period after the new time
+	p.SetTime(testStart.Add(4*time.Hour + 30*time.Minute))
+	expectTick(t, ticker, testStart.Add(4*time.Hour+30*time.Minute))
+	p.SetTime(testStart.Add(5 * time.Hour))
+	expectTick(t, ticker, testStart.Add(5*time.Hour))
+}
+
+func TestTickerIsRebasedWhenTimeMovesBackwards(t *testing.T) {
+	p := NewSimulatedProvider(testStart)
+	ticker := p.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	// Without rebasing, the ticker wouldn't fire again until a day later
+	earlier := testStart.AddDate(0, 0, -1)
+	p.SetTime(earlier)
+	expectNoTick(t, ticker)
+	p.SetTime(earlier.Add(time.Hour))
+	expectTick(t, ticker, earlier.Add(time.Hour))
+}
+
+func TestTimerIsNotRebasedWhenTimeMovesBackwards(t *testing.T) {
+	p := NewSimulatedProvider(testStart)
+	c := p.After(time.Hour)
+
+	// One-off timers wait for the time they were set for, like Sleep
+	p.SetTime(testStart.Add(-time.Hour))
+	p.SetTime(testStart.Add(30 * time.Minute))
+	select {
+	case got := <-c:
+		t.Fatalf("fired at %s, before its deadline", got)
+	default:
+	}
+	p.SetTime(testStart.Add(time.Hour))
+	select {
+	case <-c:
+	default:
+		t.Fatalf("didn't fire at its deadline")
+	}
+}
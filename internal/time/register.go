@@ -0,0 +1,152 @@
+package time
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattgallagher92/library-book-tracker/internal/config"
+	timev1 "github.com/mattgallagher92/library-book-tracker/proto/time/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// registerRetryInterval is how long to wait before retrying registration, e.g. if the time service isn't running yet,
+// or following time changed events
+const registerRetryInterval = 2 * time.Second
+
+// heartbeatInterval is how often a registered service checks that the time service still has its registration
+const heartbeatInterval = 10 * time.Second
+
+// Register registers the service listening on address with the time service, retrying until it succeeds or ctx is
+// cancelled, then sets the provider's clock to match the time service's. Registrations only last as long as the time
+// service runs, so it then checks the time service's clock every heartbeatInterval and registers again if it can't be
+// reached or its clock no longer matches the provider's, e.g. because it restarted and stopped sending updates.
+func Register(ctx context.Context, timeServiceAddress, address string, kind timev1.ClientKind, provider *SimulatedProvider) {
+	conn, err := grpc.NewClient(timeServiceAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Printf("Failed to connect to time service at %s: %v", timeServiceAddress, err)
+		return
+	}
+	defer conn.Close()
+	client := timev1.NewTimeServiceClient(conn)
+
+	for {
+		if !register(ctx, client, timeServiceAddress, address, kind, provider) {
+			return
+		}
+		heartbeat(ctx, client, timeServiceAddress, provider)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// register registers with the time service, retrying until it succeeds. It returns false if ctx is cancelled first.
+func register(ctx context.Context, client timev1.TimeServiceClient, timeServiceAddress, address string, kind timev1.ClientKind, provider *SimulatedProvider) bool {
+	for {
+		resp, err := client.RegisterClient(ctx, &timev1.RegisterClientRequest{Address: address, Kind: kind})
+		if err == nil {
+			t, parseErr := time.Parse(time.RFC3339, resp.Timestamp)
+			if parseErr == nil {
+				provider.SetClock(Clock{Time: t, Rate: resp.Rate, Paused: resp.Paused})
+				log.Printf("Registered with time service at %s; simulated time is %s (rate %g, paused %t)",
+					timeServiceAddress, resp.Timestamp, resp.Rate, resp.Paused)
+				return true
+			}
+			err = fmt.Errorf("invalid timestamp %q: %w", resp.Timestamp, parseErr)
+		}
+		log.Printf("Failed to register with time service at %s, retrying in %s: %v", timeServiceAddress, registerRetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(registerRetryInterval):
+		}
+	}
+}
+
+// heartbeat checks the time service's clock every heartbeatInterval, returning once the time service can't be reached
+// or its clock doesn't match the provider's, or ctx is cancelled
+func heartbeat(ctx context.Context, client timev1.TimeServiceClient, timeServiceAddress string, provider *SimulatedProvider) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		requestCtx, cancel := context.WithTimeout(ctx, heartbeatInterval)
+		sent := time.Now()
+		resp, err := client.GetTime(requestCtx, &timev1.GetTimeRequest{})
+		roundTrip := time.Since(sent)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to get time from time service at %s, registering again: %v", timeServiceAddress, err)
+			return
+		}
+		t, err := time.Parse(time.RFC3339, resp.Timestamp)
+		if err != nil {
+			log.Printf("Time service at %s returned invalid timestamp %q, registering again: %v", timeServiceAddress, resp.Timestamp, err)
+			return
+		}
+		if local := provider.Clock(); !clocksMatch(local, Clock{Time: t, Rate: resp.Rate, Paused: resp.Paused}, roundTrip) {
+			log.Printf("Simulated time from time service at %s is %s (rate %g, paused %t) but is %s here (rate %g, paused %t); registering again",
+				timeServiceAddress, resp.Timestamp, resp.Rate, resp.Paused,
+				local.Time.Format(time.RFC3339), local.Rate, local.Paused)
+			return
+		}
+	}
+}
+
+// clocksMatch reports whether a local clock matches the time service's, allowing for the time service's clock being
+// read up to roundTrip earlier and its time being truncated to the second
+func clocksMatch(local, remote Clock, roundTrip time.Duration) bool {
+	if local.Paused != remote.Paused || local.Rate != remote.Rate {
+		return false
+	}
+	tolerance := time.Second
+	if !local.Paused {
+		tolerance += time.Duration(float64(roundTrip) * local.Rate)
+	}
+	diff := local.Time.Sub(remote.Time)
+	return diff >= -tolerance && diff <= tolerance
+}
+
+// TimeChangedSchemaPath is where services find the Avro schema for time changed events
+const TimeChangedSchemaPath = "schemas/avro/events/time_changed.avsc"
+
+// Receive starts receiving simulated time from the time service in the background, either by registering with it or
+// by following the time changed events that it broadcasts
+func Receive(ctx context.Context, cfg config.SimulatedTimeConfig, kind timev1.ClientKind, provider *SimulatedProvider) {
+	if cfg.TimeBroadcast != config.TimeBroadcastKafka {
+		go Register(ctx, cfg.TimeServiceAddress, cfg.AdvertiseAddress, kind, provider)
+		return
+	}
+
+	codec, err := LoadTimeChangedCodec(TimeChangedSchemaPath)
+	if err != nil {
+		log.Fatalf("Failed to load time changed Avro schema: %v", err)
+	}
+	go func() {
+		for {
+			err := Follow(ctx, cfg.BroadcastKafka, codec, provider)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Stopped following simulated time, retrying in %s: %v", registerRetryInterval, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(registerRetryInterval):
+			}
+		}
+	}()
+}